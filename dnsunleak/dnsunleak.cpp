@@ -166,6 +166,47 @@ int main(int argc, char **argv) {
   }
   wcout << "whitelisted traffic on " << TAP_DEVICE_NAME << " with filter " << filterId << endl;
 
+  // Whitelist the traffic of the application given as argument, the service
+  // forwarding some queries to other DNS servers.
+  if (argc > 1) {
+    WCHAR appPath[MAX_PATH];
+    if (MultiByteToWideChar(CP_ACP, 0, argv[1], -1, appPath, MAX_PATH) == 0) {
+      wcerr << "invalid application path: " << GetLastError() << endl;
+      return 1;
+    }
+    FWP_BYTE_BLOB *appId = NULL;
+    result = FwpmGetAppIdFromFileName0(appPath, &appId);
+    if (result != ERROR_SUCCESS) {
+      wcerr << "could not get application id of " << appPath << ": " << result << endl;
+      return 1;
+    }
+
+    FWPM_FILTER_CONDITION0 appWhitelistCondition[1];
+    appWhitelistCondition[0].fieldKey = FWPM_CONDITION_ALE_APP_ID;
+    appWhitelistCondition[0].matchType = FWP_MATCH_EQUAL;
+    appWhitelistCondition[0].conditionValue.type = FWP_BYTE_BLOB_TYPE;
+    appWhitelistCondition[0].conditionValue.byteBlob = appId;
+
+    FWPM_FILTER0 appWhitelistFilter;
+    memset(&appWhitelistFilter, 0, sizeof(appWhitelistFilter));
+    appWhitelistFilter.filterCondition = appWhitelistCondition;
+    appWhitelistFilter.numFilterConditions = 1;
+    appWhitelistFilter.displayData.name = (PWSTR)FILTER_PROVIDER_NAME;
+    appWhitelistFilter.subLayerKey = sublayer.subLayerKey;
+    appWhitelistFilter.layerKey = FWPM_LAYER_ALE_AUTH_CONNECT_V4;
+    appWhitelistFilter.action.type = FWP_ACTION_PERMIT;
+    appWhitelistFilter.weight.type = FWP_UINT64;
+    appWhitelistFilter.weight.uint64 = &HIGHER_FILTER_WEIGHT;
+
+    result = FwpmFilterAdd0(engine, &appWhitelistFilter, NULL, &filterId);
+    FwpmFreeMemory0((void **)&appId);
+    if (result != ERROR_SUCCESS) {
+      wcerr << "could not whitelist traffic of " << appPath << ": " << result << endl;
+      return 1;
+    }
+    wcout << "whitelisted traffic of " << appPath << " with filter " << filterId << endl;
+  }
+
   // Wait forever.
   system("pause");
 }
@@ -0,0 +1,348 @@
+// Package diag checks the components the service depends on and reports
+// their status, to find out why resolution fails on a given host.
+package diag
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nextdns/windows/discovery"
+	"github.com/nextdns/windows/proxy"
+	"github.com/nextdns/windows/settings"
+	"github.com/nextdns/windows/tun"
+	"github.com/nextdns/windows/windoh"
+)
+
+const (
+	// DefaultTimeout defines the default value for Runner Timeout.
+	DefaultTimeout = 5 * time.Second
+
+	// routerHost is the host of the API selecting the NextDNS endpoint.
+	routerHost = "router.nextdns.io"
+
+	// testName is the name queried through the proxy. NextDNS answers it
+	// with the status of the resolution in a TXT record.
+	testName = "test.nextdns.io."
+)
+
+// Result is the outcome of a check.
+type Result struct {
+	Name string
+	OK   bool
+
+	// Skipped is true if the check does not apply, e.g. checks of the proxy
+	// when native DoH is used.
+	Skipped bool
+
+	Error    string
+	Duration time.Duration
+
+	// Info holds the details of the check, for instance the address tested.
+	Info map[string]interface{}
+}
+
+// Data returns r in the format sent to clients.
+func (r Result) Data() map[string]interface{} {
+	d := map[string]interface{}{
+		"name":       r.Name,
+		"ok":         r.OK,
+		"durationMs": ms(r.Duration),
+	}
+	if r.Skipped {
+		d["skipped"] = true
+	}
+	if r.Error != "" {
+		d["error"] = r.Error
+	}
+	for k, v := range r.Info {
+		d[k] = v
+	}
+	return d
+}
+
+// Report is the outcome of all the checks.
+type Report struct {
+	Time    time.Time
+	Version string
+	Results []Result
+}
+
+// OK returns true if all the checks passed.
+func (r Report) OK() bool {
+	for _, res := range r.Results {
+		if !res.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Data returns r in the format sent to clients.
+func (r Report) Data() map[string]interface{} {
+	results := make([]interface{}, 0, len(r.Results))
+	for _, res := range r.Results {
+		results = append(results, res.Data())
+	}
+	return map[string]interface{}{
+		"time":    r.Time.UTC().Format(time.RFC3339),
+		"version": r.Version,
+		"ok":      r.OK(),
+		"results": results,
+	}
+}
+
+// Runner runs the checks.
+type Runner struct {
+	// Version is the version of the service reported.
+	Version string
+
+	// Timeout is the maximum time given to each check. If zero,
+	// DefaultTimeout is used.
+	Timeout time.Duration
+
+	// State is the current state of the proxy, one of the proxy.State*
+	// constants, so that a proxy not resolving with NextDNS is reported as
+	// such rather than as a failing query. If empty, the state is unknown,
+	// e.g. when run outside of the service.
+	State string
+}
+
+// check is a named check returning its details or an error.
+type check struct {
+	name string
+	run  func(ctx context.Context) (map[string]interface{}, error)
+	skip bool
+}
+
+// Run runs all the checks concurrently and returns their results in a stable
+// order.
+func (r *Runner) Run(ctx context.Context) Report {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	report := Report{Time: time.Now(), Version: r.Version}
+	nativeDoH := windoh.Available()
+	checks := []check{{name: "nativeDoH", run: func(context.Context) (map[string]interface{}, error) {
+		return map[string]interface{}{"inUse": nativeDoH}, nil
+	}}}
+	// The proxy is not used with native DoH.
+	checks = append(checks,
+		check{name: "adapter", run: checkAdapter, skip: nativeDoH},
+		check{name: "dnsunleak", run: checkUnleak, skip: nativeDoH},
+		queryCheck(r.State, nativeDoH),
+	)
+	for _, ip := range proxy.RouterIPs {
+		checks = append(checks, reachCheck(routerHost, ip))
+	}
+	checks = append(checks, tlsCheck(routerHost, proxy.RouterIPs[0]))
+	endpoints := append(append([]string(nil), proxy.AnycastEndpoints...), proxy.FrontingEndpoint)
+	for _, e := range endpoints {
+		host, ips, err := endpointAddrs(e)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			checks = append(checks, reachCheck(host, ip))
+		}
+		ip := ""
+		if len(ips) > 0 {
+			ip = ips[0]
+		}
+		checks = append(checks, tlsCheck(host, ip))
+	}
+	checks = append(checks, check{name: "resolvers", run: checkResolvers})
+
+	report.Results = make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c check) {
+			defer wg.Done()
+			if c.skip {
+				report.Results[i] = Result{Name: c.name, OK: true, Skipped: true}
+				return
+			}
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			info, err := c.run(ctx)
+			res := Result{Name: c.name, OK: err == nil, Duration: time.Since(start), Info: info}
+			if err != nil {
+				res.Error = err.Error()
+			}
+			report.Results[i] = res
+		}(i, c)
+	}
+	wg.Wait()
+	return report
+}
+
+// checkAdapter checks that the TAP adapter of the proxy is installed.
+func checkAdapter(context.Context) (map[string]interface{}, error) {
+	id, err := tun.AdapterID()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"componentId": id}, nil
+}
+
+// checkUnleak checks that the dnsunleak process, blocking DNS queries not
+// sent to the proxy, is running.
+func checkUnleak(ctx context.Context) (map[string]interface{}, error) {
+	out, err := exec.CommandContext(ctx, "tasklist", "/FI", "IMAGENAME eq dnsunleak.exe", "/NH", "/FO", "CSV").Output()
+	if err != nil {
+		return nil, err
+	}
+	running := strings.Contains(strings.ToLower(string(out)), "dnsunleak.exe")
+	info := map[string]interface{}{"running": running}
+	if !running {
+		return info, errors.New("dnsunleak is not running")
+	}
+	return info, nil
+}
+
+// queryCheck returns a check sending a query to the proxy and reporting the
+// response. The query is not sent if the state of the proxy shows it does not
+// resolve with NextDNS.
+func queryCheck(state string, skip bool) check {
+	return check{name: "query", skip: skip, run: func(ctx context.Context) (map[string]interface{}, error) {
+		switch state {
+		case "", proxy.StateStarted, proxy.StateReasserting:
+			return checkQuery(ctx)
+		}
+		return map[string]interface{}{"state": state}, fmt.Errorf("proxy is %s", state)
+	}}
+}
+
+// checkQuery sends a query to the proxy and reports the response.
+func checkQuery(ctx context.Context) (map[string]interface{}, error) {
+	addr := net.JoinHostPort(proxy.ResolverIPv4, "53")
+	start := time.Now()
+	rcode, txt, err := exchangeTXT(ctx, addr, testName)
+	if err != nil {
+		return map[string]interface{}{"server": addr}, err
+	}
+	info := map[string]interface{}{
+		"server":    addr,
+		"name":      testName,
+		"rcode":     rcode,
+		"latencyMs": ms(time.Since(start)),
+		"answers":   txt,
+	}
+	if rcode != 0 {
+		return info, fmt.Errorf("response code %d", rcode)
+	}
+	return info, nil
+}
+
+// reachCheck returns a check connecting to host on port 443 at ip.
+func reachCheck(host, ip string) check {
+	return check{name: "reach:" + host + "/" + ip, run: func(ctx context.Context) (map[string]interface{}, error) {
+		info := map[string]interface{}{"host": host, "ip": ip}
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip, "443"))
+		if err != nil {
+			return info, err
+		}
+		c.Close()
+		return info, nil
+	}}
+}
+
+// tlsCheck returns a check timing a TLS handshake with host at ip, or at the
+// address its name resolves to if ip is empty.
+func tlsCheck(host, ip string) check {
+	name := "tls:" + host
+	if ip != "" {
+		name += "/" + ip
+	}
+	return check{name: name, run: func(ctx context.Context) (map[string]interface{}, error) {
+		info := map[string]interface{}{"host": host}
+		addr := host
+		if ip != "" {
+			addr = ip
+		}
+		start := time.Now()
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", net.JoinHostPort(addr, "443"))
+		if err != nil {
+			return info, err
+		}
+		defer c.Close()
+		info["ip"], _, _ = net.SplitHostPort(c.RemoteAddr().String())
+		info["connectMs"] = ms(time.Since(start))
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = c.SetDeadline(deadline)
+		}
+		start = time.Now()
+		tc := tls.Client(c, &tls.Config{ServerName: host})
+		if err := tc.Handshake(); err != nil {
+			return info, err
+		}
+		info["handshakeMs"] = ms(time.Since(start))
+		info["version"] = tlsVersion(tc.ConnectionState().Version)
+		return info, nil
+	}}
+}
+
+// checkResolvers reports the resolvers of each adapter in the order they are
+// configured.
+func checkResolvers(context.Context) (map[string]interface{}, error) {
+	adapters, err := discovery.SystemSource{IncludeProxy: true}.Adapters()
+	if err != nil {
+		return nil, err
+	}
+	l := []interface{}{}
+	for _, a := range adapters {
+		resolvers := a.Resolvers
+		if resolvers == nil {
+			resolvers = []string{}
+		}
+		l = append(l, map[string]interface{}{
+			"name":      a.Name,
+			"resolvers": resolvers,
+		})
+	}
+	return map[string]interface{}{"adapters": l}, nil
+}
+
+// endpointAddrs returns the host and bootstrap IPs of e, an endpoint URL as
+// parsed by settings.ParseUpstream.
+func endpointAddrs(e string) (string, []string, error) {
+	up, err := settings.ParseUpstream(e)
+	if err != nil {
+		return "", nil, err
+	}
+	u, err := url.Parse(up.URL)
+	if err != nil {
+		return "", nil, err
+	}
+	return u.Hostname(), up.Bootstrap, nil
+}
+
+func tlsVersion(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,36 @@
+package diag
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nextdns/windows/proxy"
+)
+
+func TestQueryCheckState(t *testing.T) {
+	for _, state := range []string{proxy.StateStopped, proxy.StateDegraded, proxy.StateFailOpen, proxy.StateCaptive} {
+		info, err := queryCheck(state, false).run(context.Background())
+		if err == nil || err.Error() != "proxy is "+state {
+			t.Errorf("%s: err = %v", state, err)
+		}
+		if info["state"] != state {
+			t.Errorf("%s: info = %v", state, info)
+		}
+	}
+}
+
+func TestCheckNames(t *testing.T) {
+	tests := []struct {
+		c    check
+		want string
+	}{
+		{reachCheck("dns1.nextdns.io", "45.90.28.0"), "reach:dns1.nextdns.io/45.90.28.0"},
+		{tlsCheck("dns1.nextdns.io", "45.90.28.0"), "tls:dns1.nextdns.io/45.90.28.0"},
+		{tlsCheck("example.cloudfront.net", ""), "tls:example.cloudfront.net"},
+	}
+	for _, tt := range tests {
+		if tt.c.name != tt.want {
+			t.Errorf("name = %s, want %s", tt.c.name, tt.want)
+		}
+	}
+}
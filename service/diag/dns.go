@@ -0,0 +1,91 @@
+package diag
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+
+	"github.com/nextdns/windows/internal/dnsmsg"
+)
+
+const typeTXT = 16
+
+// exchangeTXT sends a TXT query for name, an fqdn, to the addr DNS server over
+// UDP. It returns the response code and the TXT strings of the response.
+func exchangeTXT(ctx context.Context, addr, name string) (int, []string, error) {
+	id := uint16(rand.Intn(1 << 16))
+	q := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(q, id)
+	q[2] = 0x01 // RD
+	binary.BigEndian.PutUint16(q[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return -1, nil, errors.New("invalid name")
+		}
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0, 0, typeTXT, 0, 1)
+
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return -1, nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	}
+	if _, err := c.Write(q); err != nil {
+		return -1, nil, err
+	}
+	msg := make([]byte, 4096)
+	for {
+		n, err := c.Read(msg)
+		if err != nil {
+			return -1, nil, err
+		}
+		if n >= 12 && binary.BigEndian.Uint16(msg) == id {
+			msg = msg[:n]
+			break
+		}
+	}
+	rcode := int(msg[3] & 0xf)
+	off, err := dnsmsg.SkipName(msg, 12)
+	if err != nil {
+		return rcode, nil, err
+	}
+	off += 4
+	txt := []string{}
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[6:])); i++ {
+		if off, err = dnsmsg.SkipName(msg, off); err != nil {
+			return rcode, nil, err
+		}
+		if off+10 > len(msg) {
+			return rcode, nil, dnsmsg.ErrInvalidMsg
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return rcode, nil, dnsmsg.ErrInvalidMsg
+		}
+		if typ == typeTXT {
+			var b strings.Builder
+			for rd := msg[off : off+rdlen]; len(rd) > 0; {
+				l := int(rd[0])
+				if 1+l > len(rd) {
+					return rcode, nil, dnsmsg.ErrInvalidMsg
+				}
+				b.Write(rd[1 : 1+l])
+				rd = rd[1+l:]
+			}
+			txt = append(txt, b.String())
+		}
+		off += rdlen
+	}
+	return rcode, txt, nil
+}
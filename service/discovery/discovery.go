@@ -0,0 +1,203 @@
+// Package discovery finds the DNS servers and connection-specific DNS
+// suffixes of the network adapters, so the names of local or VPN networks can
+// be resolved by their own servers.
+package discovery
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultInterval defines the default value for Table Interval.
+const DefaultInterval = 5 * time.Second
+
+// Adapter is the DNS configuration of a network adapter.
+type Adapter struct {
+	Name string
+
+	// Resolvers lists the addresses (ip:port) of the DNS servers of the
+	// adapter.
+	Resolvers []string
+
+	// Suffixes lists the connection-specific DNS suffixes of the adapter.
+	Suffixes []string
+}
+
+// Source lists the network adapters.
+type Source interface {
+	Adapters() ([]Adapter, error)
+}
+
+// Entry associates a domain suffix with the resolvers of the adapters having
+// this suffix.
+type Entry struct {
+	Suffix    string // lower-cased fqdn
+	Resolvers []string
+}
+
+// Table is a live table of the domain suffixes of the network adapters and
+// their resolvers, refreshed from Source every Interval.
+type Table struct {
+	// Source lists the adapters. If nil, SystemSource is used.
+	Source Source
+
+	// Interval is the time between two refreshes of the table. If zero,
+	// DefaultInterval is used.
+	Interval time.Duration
+
+	// OnChange is called with the new entries when the table changes.
+	OnChange func(entries []Entry)
+
+	// ErrorLog specifies an optional log function for errors.
+	ErrorLog func(error)
+
+	mu        sync.RWMutex
+	entries   []Entry
+	resolvers []string
+	stop      chan struct{}
+}
+
+// Start refreshes the table and keeps it up to date until Stop is called.
+func (t *Table) Start() {
+	t.mu.Lock()
+	if t.stop != nil {
+		t.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	t.stop = stop
+	t.mu.Unlock()
+	t.refresh()
+	go t.run(stop)
+}
+
+// Stop stops refreshing the table.
+func (t *Table) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+	}
+}
+
+func (t *Table) run(stop chan struct{}) {
+	interval := t.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.refresh()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// refresh rebuilds the table from the current adapters.
+func (t *Table) refresh() {
+	src := t.Source
+	if src == nil {
+		src = SystemSource{}
+	}
+	adapters, err := src.Adapters()
+	if err != nil {
+		if t.ErrorLog != nil {
+			t.ErrorLog(err)
+		}
+		return
+	}
+	entries, resolvers := build(adapters)
+	t.mu.Lock()
+	changed := !reflect.DeepEqual(entries, t.entries)
+	t.entries = entries
+	t.resolvers = resolvers
+	t.mu.Unlock()
+	if changed && t.OnChange != nil {
+		t.OnChange(entries)
+	}
+}
+
+// build returns the entries of the adapters along with all their resolvers.
+func build(adapters []Adapter) ([]Entry, []string) {
+	var entries []Entry
+	var resolvers []string
+	index := map[string]int{}
+	for _, a := range adapters {
+		resolvers = appendUnique(resolvers, a.Resolvers...)
+		if len(a.Resolvers) == 0 {
+			continue
+		}
+		for _, s := range a.Suffixes {
+			s = strings.Trim(strings.ToLower(s), ".")
+			if s == "" {
+				continue
+			}
+			s += "."
+			if i, found := index[s]; found {
+				entries[i].Resolvers = appendUnique(entries[i].Resolvers, a.Resolvers...)
+				continue
+			}
+			index[s] = len(entries)
+			entries = append(entries, Entry{
+				Suffix:    s,
+				Resolvers: append([]string(nil), a.Resolvers...),
+			})
+		}
+	}
+	return entries, resolvers
+}
+
+func appendUnique(l []string, vs ...string) []string {
+outer:
+	for _, v := range vs {
+		for _, e := range l {
+			if e == v {
+				continue outer
+			}
+		}
+		l = append(l, v)
+	}
+	return l
+}
+
+// Entries returns the current entries of the table.
+func (t *Table) Entries() []Entry {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]Entry(nil), t.entries...)
+}
+
+// Resolvers returns the resolvers of all the adapters.
+func (t *Table) Resolvers() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.resolvers
+}
+
+// Lookup returns the resolvers of the entry with the longest suffix matching
+// name, a lower-cased fqdn, or nil if none match.
+func (t *Table) Lookup(name string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var match *Entry
+	for i := range t.entries {
+		e := &t.entries[i]
+		if match != nil && len(e.Suffix) <= len(match.Suffix) {
+			continue
+		}
+		if name == e.Suffix || strings.HasSuffix(name, "."+e.Suffix) {
+			match = e
+		}
+	}
+	if match == nil {
+		return nil
+	}
+	return match.Resolvers
+}
@@ -0,0 +1,124 @@
+package discovery
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeSource is a Source returning the adapters set with setAdapters.
+type fakeSource struct {
+	mu       sync.Mutex
+	adapters []Adapter
+	err      error
+}
+
+func (s *fakeSource) setAdapters(adapters []Adapter, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.adapters = adapters
+	s.err = err
+}
+
+func (s *fakeSource) Adapters() ([]Adapter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Adapter(nil), s.adapters...), s.err
+}
+
+var testAdapters = []Adapter{
+	{Name: "Ethernet", Resolvers: []string{"192.168.1.1:53"}, Suffixes: []string{"Home.", "lan"}},
+	{Name: "VPN", Resolvers: []string{"10.0.0.1:53", "10.0.0.2:53"}, Suffixes: []string{"corp.example.com", "lan"}},
+	{Name: "Lab", Resolvers: []string{"10.1.0.1:53"}, Suffixes: []string{"lab.corp.example.com"}},
+	{Name: "Disconnected", Suffixes: []string{"unused"}},
+	{Name: "Wi-Fi", Resolvers: []string{"192.168.1.1:53"}, Suffixes: []string{""}},
+}
+
+func TestBuild(t *testing.T) {
+	entries, resolvers := build(testAdapters)
+	wantEntries := []Entry{
+		{Suffix: "home.", Resolvers: []string{"192.168.1.1:53"}},
+		{Suffix: "lan.", Resolvers: []string{"192.168.1.1:53", "10.0.0.1:53", "10.0.0.2:53"}},
+		{Suffix: "corp.example.com.", Resolvers: []string{"10.0.0.1:53", "10.0.0.2:53"}},
+		{Suffix: "lab.corp.example.com.", Resolvers: []string{"10.1.0.1:53"}},
+	}
+	if !reflect.DeepEqual(entries, wantEntries) {
+		t.Errorf("entries = %v, want %v", entries, wantEntries)
+	}
+	wantResolvers := []string{"192.168.1.1:53", "10.0.0.1:53", "10.0.0.2:53", "10.1.0.1:53"}
+	if !reflect.DeepEqual(resolvers, wantResolvers) {
+		t.Errorf("resolvers = %v, want %v", resolvers, wantResolvers)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	src := &fakeSource{}
+	src.setAdapters(testAdapters, nil)
+	tbl := &Table{Source: src}
+	tbl.refresh()
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"nas.home.", []string{"192.168.1.1:53"}},
+		{"home.", []string{"192.168.1.1:53"}},
+		{"intranet.corp.example.com.", []string{"10.0.0.1:53", "10.0.0.2:53"}},
+		// The longest matching suffix wins.
+		{"build.lab.corp.example.com.", []string{"10.1.0.1:53"}},
+		{"lab.corp.example.com.", []string{"10.1.0.1:53"}},
+		// Suffixes match on label boundaries.
+		{"myhome.", nil},
+		{"xcorp.example.com.", nil},
+		{"example.com.", nil},
+		{"host.unused.", nil},
+	}
+	for _, tt := range tests {
+		if got := tbl.Lookup(tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lookup(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	src := &fakeSource{}
+	var calls [][]Entry
+	var errs []error
+	tbl := &Table{
+		Source:   src,
+		OnChange: func(entries []Entry) { calls = append(calls, entries) },
+		ErrorLog: func(err error) { errs = append(errs, err) },
+	}
+
+	src.setAdapters(testAdapters[:1], nil)
+	tbl.refresh()
+	if len(calls) != 1 || len(calls[0]) != 2 {
+		t.Fatalf("OnChange calls = %v, want one with 2 entries", calls)
+	}
+
+	// Unchanged adapters.
+	tbl.refresh()
+	if len(calls) != 1 {
+		t.Errorf("OnChange called without changes: %v", calls[1:])
+	}
+
+	// Errors keep the current table.
+	src.setAdapters(nil, errors.New("failed"))
+	tbl.refresh()
+	if len(calls) != 1 || len(errs) != 1 {
+		t.Errorf("OnChange calls = %d, errors = %v after a failure", len(calls), errs)
+	}
+	if got := tbl.Lookup("nas.home."); len(got) != 1 {
+		t.Errorf("Lookup after a failure = %v", got)
+	}
+
+	src.setAdapters(testAdapters[1:2], nil)
+	tbl.refresh()
+	if len(calls) != 2 || len(calls[1]) != 2 || calls[1][0].Suffix != "corp.example.com." {
+		t.Errorf("OnChange calls = %v", calls)
+	}
+	if got := tbl.Lookup("nas.home."); got != nil {
+		t.Errorf("Lookup of a removed suffix = %v", got)
+	}
+}
@@ -0,0 +1,15 @@
+//+build !windows
+
+package discovery
+
+import "errors"
+
+// SystemSource lists the adapters of the system. It is only implemented on
+// Windows.
+type SystemSource struct {
+	IncludeProxy bool
+}
+
+func (SystemSource) Adapters() ([]Adapter, error) {
+	return nil, errors.New("not implemented")
+}
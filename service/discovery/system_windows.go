@@ -0,0 +1,81 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// tunAdapterName is the name of the adapter created by the tun package.
+	tunAdapterName = "NextDNS"
+
+	gaaFlagSkipAnycast   = 0x2
+	gaaFlagSkipMulticast = 0x4
+)
+
+// SystemSource lists the adapters of the system using the IP Helper API. The
+// adapter of the proxy, unless IncludeProxy is set, as well as the adapters
+// down, are ignored.
+type SystemSource struct {
+	IncludeProxy bool
+}
+
+func (src SystemSource) Adapters() ([]Adapter, error) {
+	size := uint32(15000)
+	var b []byte
+	for {
+		b = make([]byte, size)
+		err := windows.GetAdaptersAddresses(windows.AF_UNSPEC,
+			gaaFlagSkipAnycast|gaaFlagSkipMulticast,
+			0, (*windows.IpAdapterAddresses)(unsafe.Pointer(&b[0])), &size)
+		if err == nil {
+			break
+		}
+		if err != windows.ERROR_BUFFER_OVERFLOW {
+			return nil, fmt.Errorf("GetAdaptersAddresses: %v", err)
+		}
+	}
+	var adapters []Adapter
+	for aa := (*windows.IpAdapterAddresses)(unsafe.Pointer(&b[0])); aa != nil; aa = aa.Next {
+		name := utf16PtrToString(aa.FriendlyName)
+		if aa.OperStatus != windows.IfOperStatusUp ||
+			aa.IfType == windows.IF_TYPE_SOFTWARE_LOOPBACK ||
+			(name == tunAdapterName && !src.IncludeProxy) {
+			continue
+		}
+		a := Adapter{Name: name}
+		for dns := aa.FirstDnsServerAddress; dns != nil; dns = dns.Next {
+			ip := dns.Address.IP()
+			if ip == nil || isSiteLocalDNS(ip) {
+				continue
+			}
+			a.Resolvers = appendUnique(a.Resolvers, net.JoinHostPort(ip.String(), "53"))
+		}
+		if suffix := utf16PtrToString(aa.DnsSuffix); suffix != "" {
+			a.Suffixes = append(a.Suffixes, suffix)
+		}
+		adapters = append(adapters, a)
+	}
+	return adapters, nil
+}
+
+// isSiteLocalDNS returns true for the deprecated fec0:0:0:ffff::/64 addresses
+// Windows sets as default IPv6 DNS servers.
+func isSiteLocalDNS(ip net.IP) bool {
+	return ip.To4() == nil && ip[0] == 0xfe && ip[1] == 0xc0
+}
+
+// utf16PtrToString returns the NUL terminated UTF-16 string at p.
+func utf16PtrToString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	var s []uint16
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; ptr = unsafe.Pointer(uintptr(ptr) + 2) {
+		s = append(s, *(*uint16)(ptr))
+	}
+	return windows.UTF16ToString(s)
+}
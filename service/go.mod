@@ -6,5 +6,6 @@ require (
 	github.com/Microsoft/go-winio v0.4.14
 	github.com/denisbrodbeck/machineid v1.0.1
 	github.com/nextdns/nextdns v1.1.2
+	golang.org/x/net v0.0.0-20191105084925-a882066a44e0
 	golang.org/x/sys v0.0.0-20191115151921-52ab43148777
 )
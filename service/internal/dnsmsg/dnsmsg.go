@@ -0,0 +1,32 @@
+// Package dnsmsg holds the DNS wire format helpers shared by the proxy and
+// the diagnostics.
+package dnsmsg
+
+import "errors"
+
+// ErrInvalidMsg is returned for malformed DNS messages.
+var ErrInvalidMsg = errors.New("invalid DNS message")
+
+// SkipName returns the offset following the domain name starting at off in
+// msg. Compression pointers terminate the name.
+func SkipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return -1, ErrInvalidMsg
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			if off+2 > len(msg) {
+				return -1, ErrInvalidMsg
+			}
+			return off + 2, nil
+		case l&0xc0 != 0:
+			// Reserved label types.
+			return -1, ErrInvalidMsg
+		}
+		off += 1 + l
+	}
+}
@@ -0,0 +1,26 @@
+package dnsmsg
+
+import "testing"
+
+func TestSkipName(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+		want int
+	}{
+		{"root", []byte{0}, 1},
+		{"labels", []byte{3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0, 0xff}, 13},
+		{"pointer", []byte{3, 'w', 'w', 'w', 0xc0, 12, 0xff}, 6},
+		{"unterminated", []byte{3, 'w', 'w', 'w'}, -1},
+		{"truncated label", []byte{7, 'e', 'x'}, -1},
+		{"truncated pointer", []byte{3, 'w', 'w', 'w', 0xc0}, -1},
+		{"reserved label type", []byte{0x40, 0}, -1},
+		{"empty", nil, -1},
+	}
+	for _, tt := range tests {
+		off, err := SkipName(tt.msg, 0)
+		if off != tt.want || (err != nil) != (tt.want < 0) {
+			t.Errorf("%s: SkipName = %d, %v, want %d", tt.name, off, err, tt.want)
+		}
+	}
+}
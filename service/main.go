@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"hash/crc64"
@@ -8,12 +11,19 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/denisbrodbeck/machineid"
 
 	"github.com/nextdns/windows/ctl"
+	"github.com/nextdns/windows/diag"
+	"github.com/nextdns/windows/discovery"
+	"github.com/nextdns/windows/metrics"
 	"github.com/nextdns/windows/proxy"
+	"github.com/nextdns/windows/querylog"
 	"github.com/nextdns/windows/settings"
 	"github.com/nextdns/windows/svc"
 	"github.com/nextdns/windows/updater"
@@ -21,13 +31,61 @@ import (
 )
 
 type impl interface {
-	SetConfigID(id string)
+	SetUpstream(u settings.Upstream) error
 	SetDeviceInfo(name, model, id, version string)
 	State() string
 	Start() error
 	Stop() error
 }
 
+// cacheFlusher is implemented by impls keeping a local DNS cache.
+type cacheFlusher interface {
+	FlushCache()
+}
+
+// forwarder is implemented by impls able to forward some domains to other
+// upstreams.
+type forwarder interface {
+	SetForwardingRules(rules []settings.ForwardingRule) error
+	ForwardingRules() []settings.ForwardingRule
+}
+
+// dotFallbacker is implemented by impls able to fall back to DoT when DoH
+// fails.
+type dotFallbacker interface {
+	SetDoTFallback(enabled bool)
+}
+
+// localResolver is implemented by impls answering some names locally.
+type localResolver interface {
+	SetLocalRecords(records []settings.LocalRecord) error
+	SetHostsFiles(paths []string)
+	SetSpecialUse(s settings.SpecialUse) error
+}
+
+// captiveDetector is implemented by impls detecting captive portals.
+type captiveDetector interface {
+	SetCaptivePortal(enabled bool, probeURL string) error
+	CaptivePortal() (bool, string)
+}
+
+// failOpener is implemented by impls able to fall back to the resolvers of
+// the network when the upstream is unreachable.
+type failOpener interface {
+	SetFailOpen(enabled bool, failures int, after time.Duration)
+}
+
+// secondaryResolver is implemented by impls able to use other upstreams when
+// NextDNS is unreachable.
+type secondaryResolver interface {
+	SetSecondaryUpstreams(upstreams []string) error
+}
+
+// statsProvider is implemented by impls exposing activity counters.
+type statsProvider interface {
+	Stats() proxy.Stats
+}
+
 type nextdnsSvc struct {
 	impl impl
 	ctl  ctl.Server
@@ -54,8 +112,17 @@ func (s *nextdnsSvc) Stop(log svc.Logger) error {
 func main() {
 	debug := flag.Bool("debug", false, "Enable debug mode")
 	svcFlag := flag.String("service", "", "Control the system service (actions: install, uninstall, start, stop)")
+	diagFlag := flag.Bool("diag", false, "Run diagnostics and print a JSON report")
 	flag.Parse()
 
+	if *diagFlag {
+		if err := runDiag(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	name := "NextDNSService"
 	displayName := "NextDNS Service"
 	desc := "NextDNS DNS53 to DoH proxy."
@@ -90,7 +157,25 @@ func run(debug bool) error {
 		URL: "https://storage.googleapis.com/nextdns_windows/info.json",
 	}
 
+	reg := &metrics.Registry{}
+	countState := func(state string) {
+		reg.Counter("nextdns_state_transitions_total", "Transitions of the service state, by new state.", "state", state).Inc()
+	}
+	up.OnCheck = func(err error) {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		reg.Counter("nextdns_updater_checks_total", "Checks for updates, by result.", "result", result).Inc()
+	}
+	metricsSrv := &metrics.Server{Registry: reg}
+
 	var s *nextdnsSvc
+	var discovered *discovery.Table
+	var qlog *querylog.Log
+	var subMu sync.Mutex
+	var unsubscribe func() // stops streaming queries to clients
+	var files fileLog
 	broadcast := func(name string, data map[string]interface{}) {
 		s.log.Info(fmt.Sprintf("send event: %v %v", name, data))
 		if err := s.ctl.Broadcast(ctl.Event{Name: name, Data: data}); err != nil {
@@ -119,16 +204,97 @@ func run(debug bool) error {
 					}
 					// Apply settings
 					stg := settings.FromMap(e.Data)
-					s.impl.SetConfigID(stg.Configuration)
+					upstream, err := stg.Upstream()
+					if err == nil {
+						err = s.impl.SetUpstream(upstream)
+					}
+					if err != nil {
+						s.log.Error(fmt.Sprintf("invalid configuration: %v", err))
+						broadcast("status", map[string]interface{}{
+							"state": s.impl.State(),
+							"error": err.Error(),
+						})
+						return
+					}
 					if stg.ReportDeviceName {
 						s.impl.SetDeviceInfo(getHostname(), getModel(), getShortMachineID(), vers)
 					} else {
 						s.impl.SetDeviceInfo("", "", "", vers)
 					}
 					up.SetAutoRun(stg.CheckUpdates)
+					if fw, ok := s.impl.(forwarder); ok {
+						if err := fw.SetForwardingRules(stg.ForwardingRules); err != nil {
+							s.log.Error(fmt.Sprintf("invalid forwarding rules: %v", err))
+						}
+					}
+					if df, ok := s.impl.(dotFallbacker); ok {
+						df.SetDoTFallback(stg.DoTFallback)
+					}
+					if lr, ok := s.impl.(localResolver); ok {
+						if err := lr.SetLocalRecords(stg.LocalRecords); err != nil {
+							s.log.Error(fmt.Sprintf("invalid local records: %v", err))
+						}
+						lr.SetHostsFiles(hostsFiles(stg))
+						if err := lr.SetSpecialUse(stg.SpecialUse); err != nil {
+							s.log.Error(fmt.Sprintf("invalid special-use policy: %v", err))
+						}
+					}
+
+					if cd, ok := s.impl.(captiveDetector); ok {
+						if err := cd.SetCaptivePortal(!stg.DisableCaptivePortal, stg.CaptiveProbeURL); err != nil {
+							s.log.Error(fmt.Sprintf("invalid captive portal settings: %v", err))
+						}
+					}
+
+					if fo, ok := s.impl.(failOpener); ok {
+						switch stg.FailurePolicy {
+						case "", settings.FailClosed, settings.FailOpen:
+						default:
+							s.log.Error(fmt.Sprintf("invalid failure policy: %s", stg.FailurePolicy))
+						}
+						fo.SetFailOpen(stg.FailurePolicy == settings.FailOpen, stg.FailOpenFailures, time.Duration(stg.FailOpenTimeout)*time.Second)
+					}
+
+					if sr, ok := s.impl.(secondaryResolver); ok {
+						if err := sr.SetSecondaryUpstreams(stg.SecondaryUpstreams); err != nil {
+							s.log.Error(fmt.Sprintf("invalid secondary upstreams: %v", err))
+						}
+					}
+
+					if err := metricsSrv.SetPort(stg.MetricsPort); err != nil {
+						s.log.Error(fmt.Sprintf("cannot serve metrics: %v", err))
+					}
+
+					if qlog != nil {
+						qlog.SetEnabled(!stg.DisableQueryLog)
+						var fw *querylog.FileWriter
+						switch stg.QueryLogFormat {
+						case "":
+						case querylog.FormatJSONL, querylog.FormatCSV:
+							if stg.DisableQueryLog {
+								break
+							}
+							dir, err := queryLogDir(stg)
+							if err != nil {
+								s.log.Error(fmt.Sprintf("invalid query log directory: %v", err))
+								break
+							}
+							fw = &querylog.FileWriter{
+								Dir:      dir,
+								Format:   stg.QueryLogFormat,
+								MaxSize:  int64(stg.QueryLogMaxSize) << 20,
+								MaxAge:   time.Duration(stg.QueryLogMaxAge) * time.Hour,
+								MaxFiles: stg.QueryLogMaxFiles,
+							}
+						default:
+							s.log.Error(fmt.Sprintf("invalid query log format: %s", stg.QueryLogFormat))
+						}
+						files.set(qlog, fw, func(err error) {
+							s.log.Error(fmt.Sprintf("query log file: %v", err))
+						})
+					}
 
 					// Switch connection status
-					var err error
 					if stg.Enabled {
 						s.log.Info("Starting service")
 						err = s.impl.Start()
@@ -142,6 +308,121 @@ func run(debug bool) error {
 							"error": err.Error(),
 						})
 					}
+				case "flushCache":
+					if c, ok := s.impl.(cacheFlusher); ok {
+						c.FlushCache()
+					}
+				case "forwardingRules":
+					if fw, ok := s.impl.(forwarder); ok {
+						broadcast("forwardingRules", map[string]interface{}{
+							"rules":      settings.ForwardingRulesData(fw.ForwardingRules()),
+							"discovered": discoveredData(discovered),
+						})
+					}
+				case "setForwardingRules":
+					fw, ok := s.impl.(forwarder)
+					if !ok || e.Data == nil {
+						return
+					}
+					data := map[string]interface{}{}
+					if err := fw.SetForwardingRules(settings.ForwardingRulesFromData(e.Data["rules"])); err != nil {
+						data["error"] = err.Error()
+					}
+					data["rules"] = settings.ForwardingRulesData(fw.ForwardingRules())
+					data["discovered"] = discoveredData(discovered)
+					broadcast("forwardingRules", data)
+				case "captivePortal":
+					if cd, ok := s.impl.(captiveDetector); ok {
+						captive, url := cd.CaptivePortal()
+						broadcast("captivePortal", map[string]interface{}{
+							"captive": captive,
+							"url":     url,
+						})
+					}
+				case "queryLog":
+					if qlog == nil {
+						return
+					}
+					// Page with the ID of the last entry received as "before".
+					var before uint64
+					var limit int
+					if v, ok := e.Data["before"].(float64); ok && v > 0 {
+						before = uint64(v)
+					}
+					if v, ok := e.Data["limit"].(float64); ok {
+						limit = int(v)
+					}
+					entries := []interface{}{}
+					for _, e := range qlog.Entries(before, limit) {
+						entries = append(entries, e.Data())
+					}
+					broadcast("queryLog", map[string]interface{}{
+						"enabled": qlog.Enabled(),
+						"entries": entries,
+					})
+				case "subscribeQueries":
+					if qlog == nil {
+						return
+					}
+					enabled, _ := e.Data["enabled"].(bool)
+					subMu.Lock()
+					if enabled && unsubscribe == nil {
+						unsubscribe = streamQueries(qlog, func(e querylog.Entry) {
+							// Not logged to keep queries out of the event log.
+							if err := s.ctl.Broadcast(ctl.Event{Name: "query", Data: e.Data()}); err != nil {
+								s.log.Error(fmt.Sprintf("send event error: %v", err))
+							}
+						})
+					} else if !enabled && unsubscribe != nil {
+						unsubscribe()
+						unsubscribe = nil
+					}
+					subMu.Unlock()
+					broadcast("subscribeQueries", map[string]interface{}{"enabled": enabled})
+				case "exportQueryLog":
+					if qlog == nil || e.Data == nil {
+						return
+					}
+					name, _ := e.Data["name"].(string)
+					from, to := time.Time{}, time.Now()
+					var err error
+					if v, ok := e.Data["from"].(string); ok && v != "" {
+						from, err = time.Parse(time.RFC3339, v)
+					}
+					if v, ok := e.Data["to"].(string); ok && v != "" && err == nil {
+						to, err = time.Parse(time.RFC3339, v)
+					}
+					go func() {
+						data := map[string]interface{}{"name": name}
+						if err == nil {
+							var entries []querylog.Entry
+							if entries, err = files.entries(qlog, from, to); err == nil {
+								var path string
+								if path, err = querylog.Export(exportDir(), name, entries); err == nil {
+									data["path"] = path
+									data["count"] = len(entries)
+								}
+							}
+						}
+						if err != nil {
+							data["error"] = err.Error()
+						}
+						broadcast("exportQueryLog", data)
+					}()
+				case "metrics":
+					// Not logged as the event log would fill up when polled.
+					if err := s.ctl.Broadcast(ctl.Event{Name: "metrics", Data: map[string]interface{}{"text": reg.String()}}); err != nil {
+						s.log.Error(fmt.Sprintf("send event error: %v", err))
+					}
+				case "diagnose":
+					go func() {
+						r := &diag.Runner{Version: vers, State: s.impl.State()}
+						broadcast("diagnose", r.Run(context.Background()).Data())
+					}()
+				case "stats":
+					if sp, ok := s.impl.(statsProvider); ok {
+						broadcast("stats", statsData(sp.Stats()))
+					}
 				default:
 					s.log.Error(fmt.Sprintf("invalid event: %v", e))
 				}
@@ -152,19 +433,47 @@ func run(debug bool) error {
 	if windoh.Available() {
 		s.impl = &windoh.Config{
 			OnStateChange: func(state string) {
+				countState(state)
 				broadcast("status", map[string]interface{}{"state": state})
 			},
 		}
 	} else {
-		s.impl = &proxy.Proxy{
-			Upstream: "https://dns.nextdns.io/",
-			// Bootstrap with a fake transport that avoid DNS lookup
+		var p *proxy.Proxy
+		qlog = &querylog.Log{}
+		discovered = &discovery.Table{
+			OnChange: func(entries []discovery.Entry) {
+				s.log.Info(fmt.Sprintf("Discovered DNS suffixes: %v", entries))
+				// Cached responses may now be answered by other servers.
+				p.FlushCache()
+				// The new network may be behind a captive portal.
+				go p.DetectCaptivePortal()
+			},
+			ErrorLog: func(err error) {
+				s.log.Error(fmt.Sprintf("discovery: %v", err))
+			},
+		}
+		p = &proxy.Proxy{
+			Upstream:  "https://dns.nextdns.io/",
+			Discovery: discovered,
 			OnStateChange: func(state string) {
-				broadcast("status", map[string]interface{}{"state": state})
+				countState(state)
+				data := map[string]interface{}{"state": state}
+				if reason := p.StateReason(); reason != "" {
+					data["reason"] = reason
+				}
+				broadcast("status", data)
 			},
-			// QueryLog: func(msgID uint16, qname string) {
-			// 	s.log.Info(fmt.Sprintf("resolve %x %s", msgID, qname))
-			// },
+			OnCaptivePortal: func(captive bool, portalURL string) {
+				// Prompt the user to log in to the portal.
+				broadcast("captivePortal", map[string]interface{}{
+					"captive": captive,
+					"url":     portalURL,
+				})
+			},
+			QueryLog: func(qi proxy.QueryInfo) {
+				qlog.Add(querylog.NewEntry(qi))
+			},
+			Metrics: reg,
 			InfoLog: func(msg string) {
 				s.log.Info(msg)
 			},
@@ -172,6 +481,7 @@ func run(debug bool) error {
 				s.log.Error(fmt.Sprint(err))
 			},
 		}
+		s.impl = p
 	}
 
 	s.ctl.ErrorLog = func(err error) {
@@ -183,6 +493,9 @@ func run(debug bool) error {
 	up.ErrorLog = func(err error) {
 		s.log.Error(fmt.Sprint(err))
 	}
+	metricsSrv.ErrorLog = func(err error) {
+		s.log.Error(fmt.Sprintf("metrics: %v", err))
+	}
 	log.SetOutput(writerFunc(func(b []byte) (n int, err error) {
 		s.log.Info(string(b))
 		return len(b), nil
@@ -191,6 +504,187 @@ func run(debug bool) error {
 	return svc.Run(s, "NextDNSService", debug)
 }
 
+// runDiag runs the diagnostics and prints the report. It exits with an error
+// if a check failed.
+func runDiag() error {
+	vers := updater.CurrentVersion()
+	if vers == "" {
+		vers = "dev"
+	}
+	r := &diag.Runner{Version: vers}
+	report := r.Run(context.Background())
+	b, err := json.MarshalIndent(report.Data(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	if !report.OK() {
+		return errors.New("diagnostics failed")
+	}
+	return nil
+}
+
+func statsData(st proxy.Stats) map[string]interface{} {
+	endpoints := make([]map[string]interface{}, 0, len(st.Endpoints))
+	for _, e := range st.Endpoints {
+		endpoints = append(endpoints, map[string]interface{}{
+			"name":         e.Name,
+			"requests":     e.Requests,
+			"errors":       e.Errors,
+			"latencyP50Ms": e.LatencyP50.Milliseconds(),
+			"latencyP95Ms": e.LatencyP95.Milliseconds(),
+		})
+	}
+	return map[string]interface{}{
+		"cacheHits":    st.CacheHits,
+		"cacheMisses":  st.CacheMisses,
+		"cacheEntries": st.CacheEntries,
+		"inFlight":     st.InFlight,
+		"shed":         st.Shed,
+		"coalesced":    st.Coalesced,
+		"retried":      st.Retried,
+		"hedged":       st.Hedged,
+		"endpoints":    endpoints,
+	}
+}
+
+// discoveredData returns the entries of the t discovery table, if any.
+func discoveredData(t *discovery.Table) []interface{} {
+	l := []interface{}{}
+	if t == nil {
+		return l
+	}
+	for _, e := range t.Entries() {
+		l = append(l, map[string]interface{}{
+			"suffix":    e.Suffix,
+			"resolvers": e.Resolvers,
+		})
+	}
+	return l
+}
+
+// streamQueries calls send with the entries added to l from a goroutine, so
+// slow clients do not hold queries, until the returned function is called.
+// Entries are dropped if send cannot keep up.
+func streamQueries(l *querylog.Log, send func(querylog.Entry)) (stop func()) {
+	entries := make(chan querylog.Entry, 100)
+	done := make(chan struct{})
+	unsubscribe := l.Subscribe(func(e querylog.Entry) {
+		select {
+		case entries <- e:
+		default:
+		}
+	})
+	go func() {
+		for {
+			select {
+			case e := <-entries:
+				send(e)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		unsubscribe()
+		close(done)
+	}
+}
+
+// fileLog writes the query log to files.
+type fileLog struct {
+	mu   sync.Mutex
+	fw   *querylog.FileWriter
+	stop func()
+}
+
+// set writes the entries added to l with fw, replacing the current writer if
+// its configuration differs. If fw is nil, entries are no longer written.
+func (f *fileLog) set(l *querylog.Log, fw *querylog.FileWriter, errorLog func(error)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fw != nil && fw != nil && f.fw.Dir == fw.Dir && f.fw.Format == fw.Format &&
+		f.fw.MaxSize == fw.MaxSize && f.fw.MaxAge == fw.MaxAge && f.fw.MaxFiles == fw.MaxFiles {
+		return
+	}
+	if f.fw != nil {
+		f.stop()
+		if err := f.fw.Close(); err != nil {
+			errorLog(err)
+		}
+		f.fw, f.stop = nil, nil
+	}
+	if fw == nil {
+		return
+	}
+	var failing bool
+	f.fw = fw
+	f.stop = streamQueries(l, func(e querylog.Entry) {
+		// Report errors once, e.g. when the disk is full, not for every query.
+		err := fw.Write(e)
+		if err != nil && !failing {
+			errorLog(err)
+		}
+		failing = err != nil
+	})
+}
+
+// entries returns the entries between from and to, the oldest first, read
+// from the files if the query log is written to disk, or from l otherwise.
+func (f *fileLog) entries(l *querylog.Log, from, to time.Time) ([]querylog.Entry, error) {
+	f.mu.Lock()
+	fw := f.fw
+	f.mu.Unlock()
+	if fw == nil {
+		return l.Range(from, to), nil
+	}
+	return fw.Entries(from, to)
+}
+
+// dataDir returns the directory of the files written by the service. As the
+// service runs as SYSTEM, clients cannot have it write files elsewhere.
+func dataDir() string {
+	root := os.Getenv("ProgramData")
+	if root == "" {
+		root = `C:\ProgramData`
+	}
+	return filepath.Join(root, "NextDNS")
+}
+
+// queryLogDir returns the directory of the query log files according to stg.
+// A QueryLogDir outside of dataDir is rejected.
+func queryLogDir(stg settings.Settings) (string, error) {
+	if stg.QueryLogDir == "" {
+		return filepath.Join(dataDir(), "Logs"), nil
+	}
+	rel, err := filepath.Rel(dataDir(), stg.QueryLogDir)
+	if err != nil || !filepath.IsAbs(stg.QueryLogDir) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: must be in %s", stg.QueryLogDir, dataDir())
+	}
+	return filepath.Clean(stg.QueryLogDir), nil
+}
+
+// exportDir returns the directory of the query log exports, in dataDir.
+func exportDir() string {
+	return filepath.Join(dataDir(), "Exports")
+}
+
+// hostsFiles returns the paths of the hosts files to import according to stg.
+func hostsFiles(stg settings.Settings) []string {
+	var paths []string
+	if stg.UseSystemHosts {
+		root := os.Getenv("SystemRoot")
+		if root == "" {
+			root = `C:\Windows`
+		}
+		paths = append(paths, filepath.Join(root, "System32", "drivers", "etc", "hosts"))
+	}
+	if stg.HostsFile != "" {
+		paths = append(paths, stg.HostsFile)
+	}
+	return paths
+}
+
 type writerFunc func(p []byte) (n int, err error)
 
 func (w writerFunc) Write(p []byte) (n int, err error) {
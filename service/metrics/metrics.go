@@ -0,0 +1,268 @@
+// Package metrics implements counters and histograms exposed in the
+// Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the buckets of the
+// histograms created without buckets, suited to DNS latencies.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v uint64
+}
+
+// Inc increments c by 1.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add increments c by n.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Value returns the current value of c.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // per bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// family is a metric with all its label values.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	buckets []float64
+	series  map[string]interface{} // *Counter or *Histogram by labels
+}
+
+// Registry holds metrics by name and labels. The zero value is ready to use.
+type Registry struct {
+	mu       sync.RWMutex
+	families map[string]*family
+}
+
+// Counter returns the counter name with labels, given as name and value
+// pairs, creating it if needed. help describes the metric.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	m := r.get(name, help, "counter", nil, labels, func() interface{} {
+		return &Counter{}
+	})
+	c, _ := m.(*Counter)
+	return c
+}
+
+// Histogram returns the histogram name with labels, given as name and value
+// pairs, creating it if needed. help describes the metric and buckets are
+// the increasing upper bounds of its buckets. If nil, DefaultBuckets are
+// used.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	m := r.get(name, help, "histogram", buckets, labels, func() interface{} {
+		return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	})
+	h, _ := m.(*Histogram)
+	return h
+}
+
+func (r *Registry) get(name, help, typ string, buckets []float64, labels []string, create func() interface{}) interface{} {
+	key := labelString(labels)
+	r.mu.RLock()
+	f := r.families[name]
+	var m interface{}
+	if f != nil {
+		m = f.series[key]
+	}
+	r.mu.RUnlock()
+	if m != nil {
+		return m
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.families == nil {
+		r.families = map[string]*family{}
+	}
+	if f = r.families[name]; f == nil {
+		f = &family{name: name, help: help, typ: typ, buckets: buckets, series: map[string]interface{}{}}
+		r.families[name] = f
+	}
+	if m = f.series[key]; m == nil {
+		m = create()
+		f.series[key] = m
+	}
+	return m
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format, sorted by
+// name and labels.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	// Format outside of the lock so a slow writer does not block the creation
+	// of metrics.
+	families := r.snapshot()
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.typ)
+		for _, s := range f.series {
+			switch m := s.metric.(type) {
+			case *Counter:
+				fmt.Fprintf(bw, "%s%s %d\n", f.name, braces(s.key), m.Value())
+			case *Histogram:
+				writeHistogram(bw, f.name, s.key, m)
+			}
+		}
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// familySnapshot is a copy of a family with its series sorted by labels.
+type familySnapshot struct {
+	name, help, typ string
+	series          []series
+}
+
+type series struct {
+	key    string
+	metric interface{} // *Counter or *Histogram
+}
+
+// snapshot returns the families of r sorted by name. The values of the
+// metrics are not copied, they are read without the lock of r.
+func (r *Registry) snapshot() []familySnapshot {
+	r.mu.RLock()
+	families := make([]familySnapshot, 0, len(r.families))
+	for _, f := range r.families {
+		fs := familySnapshot{name: f.name, help: f.help, typ: f.typ, series: make([]series, 0, len(f.series))}
+		for key, m := range f.series {
+			fs.series = append(fs.series, series{key: key, metric: m})
+		}
+		families = append(families, fs)
+	}
+	r.mu.RUnlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	for _, fs := range families {
+		sort.Slice(fs.series, func(i, j int) bool { return fs.series[i].key < fs.series[j].key })
+	}
+	return families
+}
+
+// String returns the metrics in the Prometheus text format.
+func (r *Registry) String() string {
+	var b strings.Builder
+	_, _ = r.WriteTo(&b)
+	return b.String()
+}
+
+func writeHistogram(w io.Writer, name, key string, h *Histogram) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(joinLabels(key, `le="`+formatFloat(le)+`"`)), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(joinLabels(key, `le="+Inf"`)), count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(key), formatFloat(sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces(key), count)
+}
+
+// labelString returns the labels given as name and value pairs in the
+// exposition format, without braces.
+func labelString(labels []string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(labels[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
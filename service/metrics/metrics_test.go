@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// callbackWriter calls write for each Write.
+type callbackWriter func(p []byte)
+
+func (w callbackWriter) Write(p []byte) (int, error) {
+	w(p)
+	return len(p), nil
+}
+
+func TestWriteToSorted(t *testing.T) {
+	var r Registry
+	r.Counter("b_total", "B.", "k", "2").Add(3)
+	r.Counter("b_total", "B.", "k", "1").Inc()
+	r.Histogram("a_seconds", "A.", []float64{1}).Observe(0.5)
+	want := `# HELP a_seconds A.
+# TYPE a_seconds histogram
+a_seconds_bucket{le="1"} 1
+a_seconds_bucket{le="+Inf"} 1
+a_seconds_sum 0.5
+a_seconds_count 1
+# HELP b_total B.
+# TYPE b_total counter
+b_total{k="1"} 1
+b_total{k="2"} 3
+`
+	if got := r.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriteToUnlocked(t *testing.T) {
+	var r Registry
+	// Enough metrics to fill the write buffer.
+	for i := 0; i < 200; i++ {
+		r.Counter("queries_total", "Queries.", "client", strconv.Itoa(i)).Inc()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var b strings.Builder
+		_, _ = r.WriteTo(callbackWriter(func(p []byte) {
+			// Metrics can be created while writing.
+			r.Counter("new_total", "New.").Inc()
+			b.Write(p)
+		}))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteTo holds the registry lock while writing")
+	}
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Server serves the metrics of Registry at /metrics over HTTP on the
+// loopback interface.
+type Server struct {
+	Registry *Registry
+
+	// ErrorLog specifies an optional log function for errors. If not set,
+	// errors are not reported.
+	ErrorLog func(error)
+
+	mu   sync.Mutex
+	port int
+	srv  *http.Server
+}
+
+// SetPort starts serving on 127.0.0.1:port, or stops serving if port is zero.
+// The current listener is kept if port is unchanged.
+func (s *Server) SetPort(port int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if port == s.port {
+		return nil
+	}
+	if s.srv != nil {
+		_ = s.srv.Close()
+		s.srv = nil
+		s.port = 0
+	}
+	if port == 0 {
+		return nil
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = s.Registry.WriteTo(w)
+	})
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed && s.ErrorLog != nil {
+			s.ErrorLog(err)
+		}
+	}()
+	s.srv, s.port = srv, port
+	return nil
+}
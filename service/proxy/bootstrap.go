@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nextdns/windows/settings"
+)
+
+// checkBootstrap returns an error if the host of the custom server u would
+// need to be resolved. The system resolver being the proxy itself, u must
+// have bootstrap IPs or an IP as host.
+func checkBootstrap(u settings.Upstream) error {
+	if len(u.Bootstrap) > 0 {
+		return nil
+	}
+	if pu, err := url.Parse(u.URL); err == nil && net.ParseIP(pu.Hostname()) != nil {
+		return nil
+	}
+	return fmt.Errorf("%s: a bootstrap IP is required", u.URL)
+}
+
+// customTransport returns an http.RoundTripper connecting to the custom DoH
+// server of u, which must pass checkBootstrap. Bootstrap IPs are dialed in
+// order instead of resolving the host of the server.
+func customTransport(u settings.Upstream) http.RoundTripper {
+	t := &http.Transport{
+		ForceAttemptHTTP2: true,
+	}
+	if len(u.Bootstrap) == 0 {
+		return t
+	}
+	var d net.Dialer
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range u.Bootstrap {
+			var c net.Conn
+			if c, err = d.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return c, nil
+			}
+		}
+		return nil, err
+	}
+	return t
+}
+
+// customDoT returns a DoTTransport connecting to the custom DoT server of u.
+func customDoT(u settings.Upstream) (*DoTTransport, error) {
+	s := u.URL
+	if len(u.Bootstrap) > 0 {
+		s += "#" + u.Bootstrap[0]
+	}
+	return ParseDoTURL(s)
+}
+
+// isDoT returns true if u is a custom DoT server.
+func isDoT(u settings.Upstream) bool {
+	return strings.HasPrefix(u.URL, "tls://")
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"container/list"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nextdns/windows/internal/dnsmsg"
+)
+
+const (
+	// DefaultCacheSize defines the default value for Proxy CacheSize.
+	DefaultCacheSize = 10000
+
+	// DefaultCacheMaxTTL defines the default value for Proxy CacheMaxTTL.
+	DefaultCacheMaxTTL = 1 * time.Hour
+)
+
+// cacheKey identifies a cached response by its question and DNSSEC OK bit,
+// as responses to queries without it may have their DNSSEC records stripped.
+type cacheKey struct {
+	name   string // lower-cased presentation format name
+	qtype  uint16
+	qclass uint16
+	do     bool // DNSSEC OK bit
+}
+
+func newCacheKey(qry query) cacheKey {
+	return cacheKey{
+		name:   strings.ToLower(qry.name),
+		qtype:  qry.qtype,
+		qclass: qry.qclass,
+		do:     qry.opt != nil && qry.opt.do,
+	}
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     []byte
+	ttlOffs []int
+	stored  time.Time
+	expires time.Time
+}
+
+// cache is a LRU cache of DNS responses honoring records TTL.
+type cache struct {
+	mu      sync.Mutex
+	size    int
+	maxTTL  time.Duration
+	ll      *list.List
+	entries map[cacheKey]*list.Element
+}
+
+// configure sets the cache limits, evicting entries if the new size is
+// smaller than the number of cached entries.
+func (c *cache) configure(size int, maxTTL time.Duration) {
+	if size == 0 {
+		size = DefaultCacheSize
+	}
+	if maxTTL == 0 {
+		maxTTL = DefaultCacheMaxTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = size
+	c.maxTTL = maxTTL
+	c.evictLocked()
+}
+
+// get copies the response cached for key into buf with its message ID set to
+// id and its TTLs decremented by the time spent in cache. It returns the size
+// of the response and true on hit. A response larger than buf is a miss but
+// stays cached for other queries.
+func (c *cache) get(key cacheKey, id uint16, buf []byte) (int, bool) {
+	now := time.Now()
+	c.mu.Lock()
+	el := c.entries[key]
+	if el == nil {
+		c.mu.Unlock()
+		return 0, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.removeLocked(el)
+		c.mu.Unlock()
+		return 0, false
+	}
+	if len(e.msg) > len(buf) {
+		c.mu.Unlock()
+		return 0, false
+	}
+	c.ll.MoveToFront(el)
+	n := copy(buf, e.msg)
+	c.mu.Unlock()
+
+	binary.BigEndian.PutUint16(buf, id)
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, off := range e.ttlOffs {
+		ttl := binary.BigEndian.Uint32(buf[off:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(buf[off:], ttl)
+	}
+	return n, true
+}
+
+// set stores a copy of the msg response for key. Responses that are
+// truncated, have an error code other than NXDOMAIN or a TTL of zero are not
+// cached.
+func (c *cache) set(key cacheKey, msg []byte) {
+	ttl, ttlOffs, ok := responseTTL(msg)
+	if !ok || ttl == 0 {
+		return
+	}
+	now := time.Now()
+	e := &cacheEntry{
+		key:     key,
+		msg:     append([]byte(nil), msg...),
+		ttlOffs: ttlOffs,
+		stored:  now,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size < 0 {
+		// Cache disabled.
+		return
+	}
+	ttlDur := time.Duration(ttl) * time.Second
+	if c.maxTTL > 0 && ttlDur > c.maxTTL {
+		ttlDur = c.maxTTL
+	}
+	e.expires = now.Add(ttlDur)
+	if c.entries == nil {
+		c.entries = map[cacheKey]*list.Element{}
+		c.ll = list.New()
+	}
+	if el := c.entries[key]; el != nil {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.ll.PushFront(e)
+	c.evictLocked()
+}
+
+func (c *cache) evictLocked() {
+	size := c.size
+	if size < 0 {
+		size = 0
+	}
+	for c.ll != nil && c.ll.Len() > size {
+		c.removeLocked(c.ll.Back())
+	}
+}
+
+func (c *cache) removeLocked(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// flush removes all entries from the cache.
+func (c *cache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.ll = nil
+}
+
+// len returns the number of entries currently cached.
+func (c *cache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ll == nil {
+		return 0
+	}
+	return c.ll.Len()
+}
+
+// responseTTL returns the number of seconds msg can be cached along with the
+// offsets of all the TTL fields of its records. For positive answers, the TTL
+// is the lowest answer TTL. For negative answers, it is the SOA minimum as
+// defined by RFC 2308.
+func responseTTL(msg []byte) (ttl uint32, ttlOffs []int, ok bool) {
+	if len(msg) < dnsHeaderLen {
+		return 0, nil, false
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&flagTC != 0 {
+		return 0, nil, false
+	}
+	rcode := flags & 0xf
+	if rcode != rcodeSuccess && rcode != rcodeNameError {
+		return 0, nil, false
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:]))
+	arcount := int(binary.BigEndian.Uint16(msg[10:]))
+	off := dnsHeaderLen
+	for i := 0; i < qdcount; i++ {
+		var err error
+		if off, err = dnsmsg.SkipName(msg, off); err != nil || off+4 > len(msg) {
+			return 0, nil, false
+		}
+		off += 4
+	}
+	negative := ancount == 0 || rcode == rcodeNameError
+	found := false
+	for i := 0; i < ancount+nscount+arcount; i++ {
+		var h rrHeader
+		var err error
+		if h, off, err = readRR(msg, off); err != nil {
+			return 0, nil, false
+		}
+		if h.Type == typeOPT {
+			// The OPT TTL field holds the extended RCODE and flags.
+			continue
+		}
+		ttlOffs = append(ttlOffs, h.ttlOff)
+		rrTTL := h.TTL
+		switch {
+		case i < ancount:
+			if negative {
+				continue
+			}
+		case i < ancount+nscount:
+			if !negative || h.Type != typeSOA || len(h.rdata) < 4 {
+				continue
+			}
+			if soaMin := binary.BigEndian.Uint32(h.rdata[len(h.rdata)-4:]); soaMin < rrTTL {
+				rrTTL = soaMin
+			}
+		default:
+			continue
+		}
+		if !found || rrTTL < ttl {
+			ttl = rrTTL
+			found = true
+		}
+	}
+	return ttl, ttlOffs, found
+}
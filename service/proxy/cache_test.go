@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+// cacheResponse returns qry and a response to it with a single A record.
+func cacheResponse(t *testing.T, msg []byte) (query, []byte) {
+	t.Helper()
+	qry, err := parseQuery(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n := qry.writeResponse(buf, rcodeSuccess, []resourceRecord{
+		{typ: typeA, ttl: 60, rdata: net.IPv4(192, 0, 2, 1).To4()},
+	}, nil)
+	if n < 0 {
+		t.Fatal("writeResponse failed")
+	}
+	return qry, buf[:n]
+}
+
+func TestCacheDNSSECOK(t *testing.T) {
+	var c cache
+	c.configure(0, 0)
+	msg := ednsQuery(t, "example.com.", typeA)
+	qry, res := cacheResponse(t, msg)
+	c.set(newCacheKey(qry), res)
+
+	// Same question with the DO bit set.
+	msg[len(msg)-4] |= 0x80
+	doQry, err := parseQuery(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !doQry.opt.do {
+		t.Fatal("DO bit not parsed")
+	}
+	buf := make([]byte, 512)
+	if _, found := c.get(newCacheKey(doQry), doQry.id, buf); found {
+		t.Error("response to a query without DO served to a query with DO")
+	}
+	if _, found := c.get(newCacheKey(qry), qry.id, buf); !found {
+		t.Error("response not cached")
+	}
+}
+
+func TestCacheSmallBuffer(t *testing.T) {
+	var c cache
+	c.configure(0, 0)
+	qry, res := cacheResponse(t, ednsQuery(t, "example.com.", typeA))
+	key := newCacheKey(qry)
+	c.set(key, res)
+	if _, found := c.get(key, qry.id, make([]byte, len(res)-1)); found {
+		t.Error("response larger than the buffer returned")
+	}
+	if n, found := c.get(key, qry.id, make([]byte, 512)); !found || n != len(res) {
+		t.Errorf("get = %d, %v after a miss for a small buffer", n, found)
+	}
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nextdns/windows/internal/dnsmsg"
+)
+
+const (
+	// DefaultCaptiveProbeURL is the URL fetched by default to detect captive
+	// portals, the one used by Windows.
+	DefaultCaptiveProbeURL = "http://www.msftconnecttest.com/connecttest.txt"
+
+	// defaultCaptiveProbeBody is the content served at DefaultCaptiveProbeURL.
+	defaultCaptiveProbeBody = "Microsoft Connect Test"
+
+	// DefaultCaptiveInterval is the time between two probes while a captive
+	// portal is detected.
+	DefaultCaptiveInterval = 10 * time.Second
+
+	// captiveFailureThreshold is the number of consecutive upstream failures
+	// triggering a captive portal probe.
+	captiveFailureThreshold = 3
+
+	// captiveProbeTimeout is the maximum time given to a probe.
+	captiveProbeTimeout = 5 * time.Second
+)
+
+// SetCaptivePortal enables or disables the detection of captive portals. When
+// enabled, repeated upstream failures trigger an HTTP probe of probeURL, or
+// DefaultCaptiveProbeURL if empty. If the probe is intercepted, the proxy
+// enters StateCaptive and forwards the queries to the resolvers of the network
+// so the portal can be reached, until a probe goes through.
+//
+// The probe succeeds if probeURL answers 204, or 200 with the expected content
+// for DefaultCaptiveProbeURL.
+func (p *Proxy) SetCaptivePortal(enabled bool, probeURL string) error {
+	if probeURL != "" {
+		if u, err := url.Parse(probeURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s: invalid probe URL", probeURL)
+		}
+	}
+	p.mu.Lock()
+	p.captiveDisabled = !enabled
+	p.captiveProbeURL = probeURL
+	p.mu.Unlock()
+	if !enabled {
+		p.leaveCaptive()
+	}
+	return nil
+}
+
+// CaptivePortal returns true and the URL of the portal if a captive portal is
+// currently detected.
+func (p *Proxy) CaptivePortal() (bool, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return atomic.LoadInt32(&p.captive) == 1, p.captiveURL
+}
+
+// DetectCaptivePortal probes for a captive portal, e.g. after a network
+// change, unless detection is disabled or a probe is already running.
+func (p *Proxy) DetectCaptivePortal() {
+	if !atomic.CompareAndSwapInt32(&p.probing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&p.probing, 0)
+	if atomic.LoadInt32(&p.captive) == 1 {
+		// Already probing periodically.
+		return
+	}
+	p.mu.Lock()
+	disabled, probeURL := p.captiveDisabled, p.captiveProbeURL
+	p.mu.Unlock()
+	if disabled {
+		return
+	}
+	captive, portalURL, err := p.probeCaptive(probeURL)
+	if err != nil {
+		p.logErr(fmt.Errorf("captive portal probe: %v", err))
+		return
+	}
+	if captive {
+		p.enterCaptive(portalURL)
+	}
+}
+
+// enterCaptive switches to StateCaptive and probes until the portal is
+// passed.
+func (p *Proxy) enterCaptive(portalURL string) {
+	p.mu.Lock()
+	switch p.stateLocked() {
+	case StateStarted, StateFailOpen, StateDegraded:
+	default:
+		p.mu.Unlock()
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&p.captive, 0, 1) {
+		p.mu.Unlock()
+		return
+	}
+	p.captiveURL = portalURL
+	p.updateModeStateLocked("captive portal detected")
+	p.mu.Unlock()
+	p.logInfo(fmt.Sprintf("Captive portal detected: %s", portalURL))
+	if p.OnCaptivePortal != nil {
+		p.OnCaptivePortal(true, portalURL)
+	}
+	go p.watchCaptive()
+}
+
+// leaveCaptive restores the normal mode if a captive portal was detected.
+func (p *Proxy) leaveCaptive() {
+	p.mu.Lock()
+	if !atomic.CompareAndSwapInt32(&p.captive, 1, 0) {
+		p.mu.Unlock()
+		return
+	}
+	p.captiveURL = ""
+	p.updateModeStateLocked("captive portal passed")
+	p.mu.Unlock()
+	atomic.StoreInt32(&p.upstreamFailures, 0)
+	// Responses of the network resolvers may point to the portal.
+	p.cache.flush()
+	p.logInfo("Captive portal passed")
+	if p.OnCaptivePortal != nil {
+		p.OnCaptivePortal(false, "")
+	}
+}
+
+// watchCaptive probes every DefaultCaptiveInterval until the captive portal
+// is passed or the proxy is stopped.
+func (p *Proxy) watchCaptive() {
+	for atomic.LoadInt32(&p.captive) == 1 {
+		time.Sleep(DefaultCaptiveInterval)
+		p.mu.Lock()
+		state, probeURL := p.stateLocked(), p.captiveProbeURL
+		p.mu.Unlock()
+		if state == StateStopping || state == StateStopped {
+			p.leaveCaptive()
+			return
+		}
+		captive, _, err := p.probeCaptive(probeURL)
+		if err == nil && !captive {
+			p.leaveCaptive()
+			return
+		}
+	}
+}
+
+// probeCaptive fetches probeURL, or DefaultCaptiveProbeURL if empty, without
+// following redirects and resolving its host with the resolvers of the
+// network. It returns true and the URL of the portal if the probe was
+// intercepted.
+func (p *Proxy) probeCaptive(probeURL string) (bool, string, error) {
+	expectedBody := ""
+	if probeURL == "" {
+		probeURL = DefaultCaptiveProbeURL
+		expectedBody = defaultCaptiveProbeBody
+	}
+	var d net.Dialer
+	c := &http.Client{
+		Timeout: captiveProbeTimeout,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				ips, err := p.lookupSystem(ctx, host)
+				if err != nil {
+					return nil, err
+				}
+				for _, ip := range ips {
+					var c net.Conn
+					if c, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+						return c, nil
+					}
+				}
+				return nil, err
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := c.Get(probeURL)
+	if err != nil {
+		return false, "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	if err != nil {
+		return false, "", err
+	}
+	switch {
+	case res.StatusCode == http.StatusNoContent:
+		return false, "", nil
+	case res.StatusCode == http.StatusOK && (expectedBody == "" || strings.TrimSpace(string(body)) == expectedBody):
+		return false, "", nil
+	}
+	portalURL := probeURL
+	if loc, err := res.Location(); err == nil {
+		portalURL = loc.String()
+	}
+	return true, portalURL, nil
+}
+
+// lookupSystem returns the IPv4 addresses of host resolved by the resolvers
+// of the network.
+func (p *Proxy) lookupSystem(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	q, err := newQuery(strings.TrimSuffix(host, ".")+".", typeA)
+	if err != nil {
+		return nil, err
+	}
+	res, _, err := dns53Upstream{resolvers: p.systemResolvers}.exchange(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer res.body.Close()
+	msg, err := ioutil.ReadAll(res.body)
+	if err != nil {
+		return nil, err
+	}
+	off, err := dnsmsg.SkipName(msg, dnsHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	off += 4
+	var ips []net.IP
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[6:])); i++ {
+		var h rrHeader
+		if h, off, err = readRR(msg, off); err != nil {
+			return nil, err
+		}
+		if h.Type == typeA && len(h.rdata) == net.IPv4len {
+			ips = append(ips, net.IP(h.rdata))
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s: no address", host)
+	}
+	return ips, nil
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+)
+
+// flight is an upstream request shared by identical queries.
+type flight struct {
+	done    chan struct{}
+	waiters int
+	bufSize int
+	res     []byte
+	err     error
+}
+
+// coalescer makes concurrent identical queries share a single upstream
+// request.
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[cacheKey]*flight
+}
+
+// do calls resolve to write the response of qry into buf, unless an identical
+// query is already being resolved. In this case, the response of this query is
+// copied into buf with the message ID of qry once available. The returned bool
+// is true when the response was shared. Waiting for the shared response stops
+// when ctx is done.
+func (c *coalescer) do(ctx context.Context, key cacheKey, qry query, buf []byte, resolve func(buf []byte) (int, error)) (int, bool, error) {
+	c.mu.Lock()
+	if f := c.flights[key]; f != nil {
+		f.waiters++
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return -1, false, ctx.Err()
+		}
+		if f.err != nil {
+			return -1, true, f.err
+		}
+		// A response truncated to fit a smaller buffer than ours, or too large
+		// for our buffer, is resolved on our own.
+		if len(f.res) <= len(buf) && (!isTruncated(f.res) || len(buf) <= f.bufSize) {
+			n := copy(buf, f.res)
+			binary.BigEndian.PutUint16(buf, qry.id)
+			return n, true, nil
+		}
+		n, err := resolve(buf)
+		return n, false, err
+	}
+	f := &flight{done: make(chan struct{}), bufSize: len(buf)}
+	if c.flights == nil {
+		c.flights = map[cacheKey]*flight{}
+	}
+	c.flights[key] = f
+	c.mu.Unlock()
+
+	n, err := resolve(buf)
+
+	c.mu.Lock()
+	delete(c.flights, key)
+	if f.waiters > 0 {
+		if err != nil {
+			f.err = err
+		} else {
+			f.res = append([]byte(nil), buf[:n]...)
+		}
+	}
+	c.mu.Unlock()
+	close(f.done)
+	return n, false, err
+}
+
+func isTruncated(msg []byte) bool {
+	return len(msg) >= dnsHeaderLen && binary.BigEndian.Uint16(msg[2:])&flagTC != 0
+}
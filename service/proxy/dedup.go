@@ -1,22 +1,68 @@
 package proxy
 
-// dedup is a ring buffer containing the last 128 ids used to check for
-// duplicates.
+import (
+	"container/list"
+	"time"
+)
+
+const (
+	// dedupWindow is the time during which a query received again is
+	// considered a duplicate.
+	dedupWindow = 1 * time.Second
+
+	// dedupMaxEntries caps the number of queries tracked.
+	dedupMaxEntries = 4096
+)
+
+// dedupKey identifies a query from a given client socket.
+type dedupKey struct {
+	addr [16]byte
+	port uint16
+	id   uint16
+	cacheKey
+}
+
+type dedupEntry struct {
+	key  dedupKey
+	seen time.Time
+}
+
+// dedup tracks the queries received during the last dedupWindow to detect
+// duplicates. Queries are identified by their source address and port,
+// message ID and question so distinct queries sharing an ID are not mistaken
+// for duplicates.
 type dedup struct {
-	ids [128]uint16
-	pos int
+	entries map[dedupKey]*list.Element
+	ll      *list.List
 }
 
-// IsDup returns true if id is present in the ring buffer. If not found, the id
-// is added to the ring. Call to this function is not thread safe.
-func (d *dedup) IsDup(id uint16) bool {
-	for _, id2 := range d.ids {
-		if id == id2 {
-			return true
+// IsDup returns true if the qry query received from f was already seen during
+// the dedup window. If not found, the query is recorded. Call to this function
+// is not thread safe.
+func (d *dedup) IsDup(f flow, qry query) bool {
+	now := time.Now()
+	if d.entries == nil {
+		d.entries = map[dedupKey]*list.Element{}
+		d.ll = list.New()
+	}
+	// Entries are ordered by time, expire the oldest ones.
+	for el := d.ll.Back(); el != nil; el = d.ll.Back() {
+		e := el.Value.(*dedupEntry)
+		if now.Sub(e.seen) < dedupWindow && d.ll.Len() < dedupMaxEntries {
+			break
 		}
+		d.ll.Remove(el)
+		delete(d.entries, e.key)
+	}
+	key := dedupKey{
+		port:     f.srcPort,
+		id:       qry.id,
+		cacheKey: newCacheKey(qry),
+	}
+	copy(key.addr[:], f.src.To16())
+	if _, found := d.entries[key]; found {
+		return true
 	}
-	d.ids[d.pos] = id
-	d.pos++
-	d.pos &= 127 // power of 2 modulo
+	d.entries[key] = d.ll.PushFront(&dedupEntry{key: key, seen: now})
 	return false
 }
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func dedupQuery(t *testing.T, id uint16, name string) query {
+	t.Helper()
+	msg, err := newQuery(name, typeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint16(msg, id)
+	qry, err := parseQuery(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return qry
+}
+
+func TestDedup(t *testing.T) {
+	src := net.IPv4(192, 168, 1, 10)
+	f := flow{src: src, dst: net.ParseIP(ResolverIPv4), srcPort: 50000, dstPort: 53}
+	otherPort := f
+	otherPort.srcPort = 50001
+	otherSrc := f
+	otherSrc.src = net.IPv4(192, 168, 1, 11)
+
+	tests := []struct {
+		name string
+		f    flow
+		qry  query
+		dup  bool
+	}{
+		{"first", f, dedupQuery(t, 1, "example.com."), false},
+		{"same ID, different name", f, dedupQuery(t, 1, "example.net."), false},
+		{"same ID, different port", otherPort, dedupQuery(t, 1, "example.com."), false},
+		{"same ID, different source", otherSrc, dedupQuery(t, 1, "example.com."), false},
+		{"different ID", f, dedupQuery(t, 2, "example.com."), false},
+		{"duplicate", f, dedupQuery(t, 1, "example.com."), true},
+		{"duplicate, other port", otherPort, dedupQuery(t, 1, "example.com."), true},
+	}
+	var d dedup
+	for _, tt := range tests {
+		if got := d.IsDup(tt.f, tt.qry); got != tt.dup {
+			t.Errorf("%s: IsDup = %v, want %v", tt.name, got, tt.dup)
+		}
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	f := flow{src: net.IPv4(192, 168, 1, 10), dst: net.ParseIP(ResolverIPv4), srcPort: 50000, dstPort: 53}
+	qry := dedupQuery(t, 1, "example.com.")
+	var d dedup
+	if d.IsDup(f, qry) {
+		t.Fatal("first query reported as duplicate")
+	}
+	// Age the entry past the window: the query is no longer a duplicate.
+	d.ll.Front().Value.(*dedupEntry).seen = time.Now().Add(-dedupWindow)
+	if d.IsDup(f, qry) {
+		t.Error("query outside the window reported as duplicate")
+	}
+	if !d.IsDup(f, qry) {
+		t.Error("query inside the window not reported as duplicate")
+	}
+}
+
+// fakeTun is a tun device reading the packets sent to in and writing to out.
+type fakeTun struct {
+	in     chan []byte
+	out    chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeTun() *fakeTun {
+	return &fakeTun{in: make(chan []byte), out: make(chan []byte, 10), closed: make(chan struct{})}
+}
+
+func (t *fakeTun) Read(b []byte) (int, error) {
+	select {
+	case pkt := <-t.in:
+		return copy(b, pkt), nil
+	case <-t.closed:
+		return 0, io.EOF
+	}
+}
+
+func (t *fakeTun) Write(b []byte) (int, error) {
+	select {
+	case t.out <- append([]byte(nil), b...):
+		return len(b), nil
+	case <-t.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (t *fakeTun) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
+
+// runProxy runs p on a fake tun device until the returned function is
+// called.
+func runProxy(t *testing.T, p *Proxy) (*fakeTun, func()) {
+	t.Helper()
+	tun := newFakeTun()
+	p.mu.Lock()
+	p.tun = tun
+	p.setStateLocked(StateStarting)
+	p.stop = make(chan struct{})
+	go p.run(p.stop)
+	p.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.State() != StateStarted {
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy %s", p.State())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return tun, func() {
+		_ = p.Stop()
+		for p.State() != StateStopped {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// udpQuery returns a query packet for name with id sent from f.
+func udpQuery(t *testing.T, f flow, id uint16, name string) []byte {
+	t.Helper()
+	q := dedupQuery(t, id, name).msg
+	buf := make([]byte, f.headerLen()+len(q))
+	n := copy(buf[f.headerLen():], q)
+	return writeUDP(buf, f, n)
+}
+
+// Distinct queries sharing an ID from the same socket must both be answered.
+func TestDedupSameIDAnswered(t *testing.T) {
+	s := newDoTServer(t, 1)
+	defer s.ln.Close()
+	p := &Proxy{DoT: s.transport()}
+	tun, stop := runProxy(t, p)
+	defer stop()
+
+	f := flow{src: net.IPv4(192, 168, 1, 10), dst: net.ParseIP(ResolverIPv4), srcPort: 50000, dstPort: 53}
+	names := map[string]bool{"a.example.com.": true, "b.example.com.": true}
+	for name := range names {
+		tun.in <- udpQuery(t, f, 0x4242, name)
+	}
+	for range names {
+		var pkt []byte
+		select {
+		case pkt = <-tun.out:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing replies for %v", names)
+		}
+		rf, res, err := parseUDP(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rf.dstPort != f.srcPort || binary.BigEndian.Uint16(res) != 0x4242 {
+			t.Errorf("reply to port %d with ID %#x", rf.dstPort, binary.BigEndian.Uint16(res))
+		}
+		name, _, err := parseQName(res, dnsHeaderLen)
+		if err != nil || !names[name] {
+			t.Fatalf("unexpected reply for %q (%v)", name, err)
+		}
+		delete(names, name)
+	}
+}
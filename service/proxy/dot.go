@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDoTIdleTimeout defines the default value for DoTTransport
+	// IdleTimeout.
+	DefaultDoTIdleTimeout = 30 * time.Second
+
+	dotPort = "853"
+)
+
+var errDoTClosed = errors.New("dot: connection closed")
+
+// DoTTransport sends DNS queries over TLS (RFC 7858). A single connection is
+// kept open and reused, queries being pipelined over it: several queries can
+// be waiting for their response at the same time, the responses being
+// matched by message ID.
+type DoTTransport struct {
+	// Addr is the host:port address of the server.
+	Addr string
+
+	// ServerName is the name used to verify the certificate of the server.
+	// If empty, the host of Addr is used.
+	ServerName string
+
+	// TLSConfig specifies an optional TLS configuration. ServerName takes
+	// precedence over TLSConfig.ServerName.
+	TLSConfig *tls.Config
+
+	// IdleTimeout is the time after which a connection without activity is
+	// closed. If zero, DefaultDoTIdleTimeout is used.
+	IdleTimeout time.Duration
+
+	mu   sync.Mutex
+	conn *dotConn
+}
+
+// ParseDoTURL returns a DoTTransport for a tls://host[:port][#ip] URL. As
+// with endpoint.New, the optional fragment gives the IP address to connect
+// to, avoiding a DNS lookup of host.
+func ParseDoTURL(s string) (*DoTTransport, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "tls" || u.Hostname() == "" {
+		return nil, fmt.Errorf("%s: invalid DoT URL", s)
+	}
+	port := u.Port()
+	if port == "" {
+		port = dotPort
+	}
+	host := u.Hostname()
+	if u.Fragment != "" {
+		host = u.Fragment
+	}
+	return &DoTTransport{
+		Addr:       net.JoinHostPort(host, port),
+		ServerName: u.Hostname(),
+	}, nil
+}
+
+// Exchange sends the q query and returns its response.
+func (t *DoTTransport) Exchange(ctx context.Context, q []byte) ([]byte, error) {
+	if len(q) < dnsHeaderLen || len(q) > maxMsgSize {
+		return nil, errInvalidMsg
+	}
+	for {
+		c, reused, err := t.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res, err := c.exchange(ctx, q)
+		if err == errDoTClosed && reused && ctx.Err() == nil {
+			// The server closed the idle connection we reused, retry on a
+			// new one.
+			continue
+		}
+		return res, err
+	}
+}
+
+// exchange implements upstream.
+func (t *DoTTransport) exchange(ctx context.Context, q []byte) (*response, string, error) {
+	res, err := t.Exchange(ctx, q)
+	if err != nil {
+		return nil, t.Addr, err
+	}
+	return &response{body: ioutil.NopCloser(bytes.NewReader(res)), maxAge: -1}, t.Addr, nil
+}
+
+// getConn returns the current connection, dialing a new one if needed. The
+// returned bool is true if the connection was already established.
+func (t *DoTTransport) getConn(ctx context.Context) (*dotConn, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil && !t.conn.isClosed() {
+		return t.conn, true, nil
+	}
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", t.Addr)
+	if err != nil {
+		return nil, false, err
+	}
+	conf := &tls.Config{}
+	if t.TLSConfig != nil {
+		conf = t.TLSConfig.Clone()
+	}
+	if t.ServerName != "" {
+		conf.ServerName = t.ServerName
+	}
+	if conf.ServerName == "" {
+		conf.ServerName, _, _ = net.SplitHostPort(t.Addr)
+	}
+	tc := tls.Client(nc, conf)
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = tc.SetDeadline(deadline)
+	}
+	if err := tc.Handshake(); err != nil {
+		tc.Close()
+		return nil, false, err
+	}
+	_ = tc.SetDeadline(time.Time{})
+	idle := t.IdleTimeout
+	if idle <= 0 {
+		idle = DefaultDoTIdleTimeout
+	}
+	t.conn = &dotConn{
+		conn:    tc,
+		idle:    idle,
+		waiters: map[uint16]chan []byte{},
+	}
+	go t.conn.readLoop()
+	return t.conn, false, nil
+}
+
+// Close closes the current connection, if any.
+func (t *DoTTransport) Close() error {
+	t.mu.Lock()
+	c := t.conn
+	t.conn = nil
+	t.mu.Unlock()
+	if c != nil {
+		c.close()
+	}
+	return nil
+}
+
+// dotConn is a TLS connection on which queries are pipelined. The queries
+// are sent with IDs unique to the connection, the original IDs being restored
+// in the responses.
+type dotConn struct {
+	conn net.Conn
+	idle time.Duration
+
+	wmu sync.Mutex // serializes writes
+
+	mu      sync.Mutex
+	nextID  uint16
+	waiters map[uint16]chan []byte
+	closed  bool
+}
+
+func (c *dotConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// exchange sends q and waits for its response.
+func (c *dotConn) exchange(ctx context.Context, q []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errDoTClosed
+	}
+	if len(c.waiters) >= 0xffff {
+		c.mu.Unlock()
+		return nil, errors.New("dot: too many pipelined queries")
+	}
+	id := c.nextID
+	for c.waiters[id] != nil {
+		id++
+	}
+	c.nextID = id + 1
+	c.waiters[id] = ch
+	c.mu.Unlock()
+
+	msg := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(msg, uint16(len(q)))
+	copy(msg[2:], q)
+	binary.BigEndian.PutUint16(msg[2:], id)
+	c.wmu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetWriteDeadline(deadline)
+	}
+	_, err := c.conn.Write(msg)
+	c.wmu.Unlock()
+	if err != nil {
+		c.close()
+		return nil, errDoTClosed
+	}
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return nil, errDoTClosed
+		}
+		binary.BigEndian.PutUint16(res, binary.BigEndian.Uint16(q))
+		return res, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		if c.waiters[id] == ch {
+			delete(c.waiters, id)
+		}
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// readLoop dispatches the responses received to the waiting queries until
+// the connection fails or stays idle for too long.
+func (c *dotConn) readLoop() {
+	defer c.close()
+	var l [2]byte
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.idle))
+		if _, err := io.ReadFull(c.conn, l[:]); err != nil {
+			return
+		}
+		res := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(c.conn, res); err != nil {
+			return
+		}
+		if len(res) < dnsHeaderLen {
+			return
+		}
+		id := binary.BigEndian.Uint16(res)
+		c.mu.Lock()
+		ch := c.waiters[id]
+		delete(c.waiters, id)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- res
+		}
+	}
+}
+
+// close closes the connection and fails the queries waiting for a response.
+func (c *dotConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.conn.Close()
+	for id, ch := range c.waiters {
+		close(ch)
+		delete(c.waiters, id)
+	}
+}
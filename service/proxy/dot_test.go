@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nextdns/windows/settings"
+)
+
+// dotServer is a local DoT stand-in answering queries with a copy of the
+// query with QR set.
+type dotServer struct {
+	ln   net.Listener
+	pool *x509.CertPool
+
+	// batch is the number of queries read before answering them in reverse
+	// order, to check that responses are matched to queries by ID.
+	batch int
+
+	mu    sync.Mutex
+	conns int
+	ids   []uint16 // IDs received on the wire
+}
+
+func newDoTServer(t *testing.T, batch int) *dotServer {
+	t.Helper()
+	// Borrow the certificate of httptest, valid for 127.0.0.1 and
+	// example.com.
+	hs := httptest.NewTLSServer(nil)
+	cert := hs.TLS.Certificates[0]
+	pool := x509.NewCertPool()
+	pool.AddCert(hs.Certificate())
+	hs.Close()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dotServer{ln: ln, pool: pool, batch: batch}
+	go s.serve()
+	return s
+}
+
+func (s *dotServer) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+func (s *dotServer) handle(c net.Conn) {
+	defer c.Close()
+	for {
+		var qs [][]byte
+		for len(qs) < s.batch {
+			var l [2]byte
+			if _, err := io.ReadFull(c, l[:]); err != nil {
+				return
+			}
+			q := make([]byte, binary.BigEndian.Uint16(l[:]))
+			if _, err := io.ReadFull(c, q); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.ids = append(s.ids, binary.BigEndian.Uint16(q))
+			s.mu.Unlock()
+			qs = append(qs, q)
+		}
+		for i := len(qs) - 1; i >= 0; i-- {
+			res := append([]byte{0, 0}, qs[i]...)
+			binary.BigEndian.PutUint16(res, uint16(len(qs[i])))
+			res[4] |= flagQR >> 8
+			if _, err := c.Write(res); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *dotServer) transport() *DoTTransport {
+	return &DoTTransport{
+		Addr:       s.ln.Addr().String(),
+		ServerName: "example.com",
+		TLSConfig:  &tls.Config{RootCAs: s.pool},
+	}
+}
+
+func TestDoTPipelining(t *testing.T) {
+	const n = 5
+	s := newDoTServer(t, n)
+	defer s.ln.Close()
+	dot := s.transport()
+	defer dot.Close()
+	// Establish the connection first so all the queries share it.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := dot.getConn(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"a.example.", "b.example.", "c.example.", "d.example.", "e.example."}
+	errs := make(chan error, n)
+	for _, name := range names {
+		go func(name string) {
+			q, err := newQuery(name, typeA)
+			if err != nil {
+				errs <- err
+				return
+			}
+			// All the queries have the same ID, remapped on the wire.
+			binary.BigEndian.PutUint16(q, 0x1234)
+			res, err := dot.Exchange(ctx, q)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if id := binary.BigEndian.Uint16(res); id != 0x1234 {
+				t.Errorf("%s: response ID = %#x, want 0x1234", name, id)
+			}
+			if got, _, err := parseQName(res, dnsHeaderLen); err != nil || got != name {
+				t.Errorf("%s: response for %q (%v)", name, got, err)
+			}
+			errs <- nil
+		}(name)
+	}
+	for range names {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns != 1 {
+		t.Errorf("%d connections, want 1", s.conns)
+	}
+	seen := map[uint16]bool{}
+	for _, id := range s.ids {
+		if seen[id] {
+			t.Errorf("ID %#x sent twice on the connection", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestDoTReconnect(t *testing.T) {
+	s := newDoTServer(t, 1)
+	defer s.ln.Close()
+	dot := s.transport()
+	defer dot.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	q, err := newQuery("example.", typeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dot.Exchange(ctx, q); err != nil {
+		t.Fatal(err)
+	}
+	// The server drops the connection: the next query uses a new one.
+	dot.mu.Lock()
+	dot.conn.conn.Close()
+	dot.mu.Unlock()
+	if _, err := dot.Exchange(ctx, q); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns != 2 {
+		t.Errorf("%d connections, want 2", s.conns)
+	}
+}
+
+func TestNextDNSDoT(t *testing.T) {
+	p := &Proxy{}
+	defer p.Stop()
+	if err := p.SetUpstream(settings.Upstream{ConfigID: "abc123"}); err != nil {
+		t.Fatal(err)
+	}
+	p.SetDoTFallback(true)
+	p.mu.Lock()
+	p.setTransportsLocked()
+	dot := p.DoT
+	p.mu.Unlock()
+	if dot == nil {
+		t.Fatal("DoT not set")
+	}
+	if dot.Addr != nextdnsDoTIP+":853" || dot.ServerName != "abc123.dns.nextdns.io" {
+		t.Errorf("DoT = %s (%s)", dot.Addr, dot.ServerName)
+	}
+
+	// Custom DoH upstreams do not get NextDNS DoT.
+	if err := p.SetUpstream(settings.Upstream{URL: "https://doh.example/dns-query", Bootstrap: []string{"192.0.2.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.setTransportsLocked()
+	dot = p.DoT
+	p.mu.Unlock()
+	if dot != nil {
+		t.Errorf("DoT = %s, want none", dot.Addr)
+	}
+}
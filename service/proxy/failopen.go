@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultFailOpenFailures is the default number of consecutive upstream
+	// failures switching to StateFailOpen.
+	DefaultFailOpenFailures = 5
+
+	// DefaultFailOpenAfter is the default time the upstream has to keep
+	// failing to switch to StateFailOpen.
+	DefaultFailOpenAfter = 15 * time.Second
+
+	// DefaultRecoveryInterval is the time between two checks of the upstream
+	// in StateFailOpen.
+	DefaultRecoveryInterval = 10 * time.Second
+
+	// recoveryProbeName is the name resolved to check the upstream.
+	recoveryProbeName = "nextdns.io."
+)
+
+// SetFailOpen sets the policy applied when the upstream is unreachable. When
+// disabled (fail-closed), queries fail until the upstream recovers. When
+// enabled (fail-open), the proxy switches to StateFailOpen and forwards the
+// queries to the resolvers of the network after failures consecutive upstream
+// failures, or when the upstream kept failing for after, whichever comes
+// first. It switches back once the upstream answers again. If zero, failures
+// and after default to DefaultFailOpenFailures and DefaultFailOpenAfter.
+func (p *Proxy) SetFailOpen(enabled bool, failures int, after time.Duration) {
+	if failures <= 0 {
+		failures = DefaultFailOpenFailures
+	}
+	if after <= 0 {
+		after = DefaultFailOpenAfter
+	}
+	p.mu.Lock()
+	p.failOpenEnabled = enabled
+	p.failOpenFailures = failures
+	p.failOpenAfter = after
+	p.mu.Unlock()
+	if !enabled {
+		p.leaveFailOpen("fail-closed policy")
+	}
+}
+
+// upstreamResult records the outcome of a query resolved by the upstream to
+// detect captive portals and switch to StateFailOpen after repeated failures.
+func (p *Proxy) upstreamResult(err error) {
+	if err == nil {
+		atomic.StoreInt32(&p.upstreamFailures, 0)
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	now := time.Now().UnixNano()
+	failures := atomic.AddInt32(&p.upstreamFailures, 1)
+	if failures == 1 {
+		atomic.StoreInt64(&p.failingSince, now)
+	}
+	if failures == captiveFailureThreshold {
+		go p.DetectCaptivePortal()
+	}
+	p.mu.Lock()
+	enabled, maxFailures, after := p.failOpenEnabled, p.failOpenFailures, p.failOpenAfter
+	p.mu.Unlock()
+	if !enabled {
+		return
+	}
+	failingFor := time.Duration(now - atomic.LoadInt64(&p.failingSince))
+	switch {
+	case int(failures) >= maxFailures:
+		p.enterFailOpen(fmt.Sprintf("%d consecutive upstream failures: %v", failures, err))
+	case failures > 1 && failingFor >= after:
+		p.enterFailOpen(fmt.Sprintf("upstream failing for %v: %v", failingFor.Round(time.Second), err))
+	}
+}
+
+// enterFailOpen switches to StateFailOpen for reason and checks the upstream
+// until it recovers.
+func (p *Proxy) enterFailOpen(reason string) {
+	p.mu.Lock()
+	if !atomic.CompareAndSwapInt32(&p.failOpen, 0, 1) {
+		p.mu.Unlock()
+		return
+	}
+	p.updateModeStateLocked(reason)
+	p.mu.Unlock()
+	p.logInfo(fmt.Sprintf("Failing open: %s", reason))
+	go p.watchFailOpen()
+}
+
+// leaveFailOpen switches back from StateFailOpen for reason.
+func (p *Proxy) leaveFailOpen(reason string) {
+	p.mu.Lock()
+	if !atomic.CompareAndSwapInt32(&p.failOpen, 1, 0) {
+		p.mu.Unlock()
+		return
+	}
+	p.updateModeStateLocked(reason)
+	p.mu.Unlock()
+	atomic.StoreInt32(&p.upstreamFailures, 0)
+	// Responses of the network resolvers are not filtered.
+	p.cache.flush()
+	p.logInfo(fmt.Sprintf("Failing closed: %s", reason))
+}
+
+// watchFailOpen resolves a name with the upstream, NextDNS or the secondary
+// upstreams in StateDegraded, every
+// DefaultRecoveryInterval until it succeeds or the proxy is stopped.
+func (p *Proxy) watchFailOpen() {
+	q, err := newQuery(recoveryProbeName, typeA)
+	if err != nil {
+		return
+	}
+	for atomic.LoadInt32(&p.failOpen) == 1 {
+		time.Sleep(DefaultRecoveryInterval)
+		if state := p.State(); state == StateStopping || state == StateStopped {
+			p.leaveFailOpen("proxy stopped")
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), p.timeout())
+		res, err := p.resolveUpstream(ctx, q)
+		if err == nil {
+			res.body.Close()
+		}
+		cancel()
+		if err == nil {
+			p.leaveFailOpen("upstream recovered")
+			return
+		}
+	}
+}
+
+// bypassed returns true if the upstream is bypassed for the resolvers of the
+// network, because of a captive portal or the fail-open policy.
+func (p *Proxy) bypassed() bool {
+	return atomic.LoadInt32(&p.captive) == 1 || atomic.LoadInt32(&p.failOpen) == 1
+}
+
+// updateModeStateLocked sets the state of a started proxy according to the
+// captive portal and fail-open modes, for reason.
+func (p *Proxy) updateModeStateLocked(reason string) {
+	switch p.stateLocked() {
+	case StateStarted, StateCaptive, StateFailOpen, StateDegraded:
+		p.setStateReasonLocked(p.modeStateLocked(), reason)
+	}
+}
+
+// modeStateLocked returns the state of a started proxy: StateCaptive,
+// StateFailOpen, StateDegraded or StateStarted.
+func (p *Proxy) modeStateLocked() string {
+	switch {
+	case atomic.LoadInt32(&p.captive) == 1:
+		return StateCaptive
+	case atomic.LoadInt32(&p.failOpen) == 1:
+		return StateFailOpen
+	case atomic.LoadInt32(&p.degraded) == 1:
+		return StateDegraded
+	default:
+		return StateStarted
+	}
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nextdns/windows/settings"
+)
+
+// dns53Timeout is the maximum time given to a DNS53 server to answer before
+// trying the next one.
+const dns53Timeout = 2 * time.Second
+
+var errNoResolver = errors.New("no resolver available")
+
+// forwardRule is a parsed settings.ForwardingRule.
+type forwardRule struct {
+	suffix string // lower-cased fqdn
+	up     upstream
+}
+
+// SetForwardingRules sets the rules forwarding the queries of some domains to
+// other upstreams than NextDNS. Queries are forwarded according to the rule
+// with the longest matching domain, the first one winning in case of tie. DoH
+// upstreams must have a bootstrap IP or an IP as host. If a rule is invalid,
+// an error is returned and the current rules are kept.
+func (p *Proxy) SetForwardingRules(rules []settings.ForwardingRule) error {
+	var fw []forwardRule
+	for _, r := range rules {
+		suffix := normalizeSuffix(r.Domain)
+		if suffix == "" {
+			return fmt.Errorf("%s: invalid domain", r.Domain)
+		}
+		up, err := p.forwardUpstream(r.Upstream)
+		if err != nil {
+			return err
+		}
+		fw = append(fw, forwardRule{suffix: suffix, up: up})
+	}
+	p.mu.Lock()
+	p.forwardingRules = append([]settings.ForwardingRule(nil), rules...)
+	p.mu.Unlock()
+	p.forwarding.Store(fw)
+	// Cached responses may come from another upstream.
+	p.cache.flush()
+	return nil
+}
+
+// ForwardingRules returns the current forwarding rules.
+func (p *Proxy) ForwardingRules() []settings.ForwardingRule {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]settings.ForwardingRule(nil), p.forwardingRules...)
+}
+
+// forwardUpstream returns the upstream for the Upstream of a rule.
+func (p *Proxy) forwardUpstream(s string) (upstream, error) {
+	switch {
+	case s == settings.ForwardSystem:
+		return dns53Upstream{resolvers: p.systemResolvers}, nil
+	case strings.HasPrefix(s, "https://"):
+		u, err := settings.ParseUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		// The host of the server would be resolved by the proxy, possibly
+		// with this very rule.
+		if err := checkBootstrap(u); err != nil {
+			return nil, err
+		}
+		return dohUpstream{p: p, rt: customTransport(u), url: u.URL}, nil
+	}
+	addr := s
+	if ip := net.ParseIP(s); ip != nil {
+		addr = net.JoinHostPort(s, "53")
+	} else if host, _, err := net.SplitHostPort(s); err != nil || net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("%s: invalid upstream", s)
+	}
+	return dns53Upstream{addrs: []string{addr}}, nil
+}
+
+// systemResolvers returns the resolvers of the network adapters.
+func (p *Proxy) systemResolvers() []string {
+	if p.Discovery == nil {
+		return nil
+	}
+	return p.Discovery.Resolvers()
+}
+
+// forwardTo returns the upstream to forward the query for name to, or nil
+// if name does not match any rule nor discovered suffix. Forwarding rules take
+// precedence over the suffixes found by Discovery.
+func (p *Proxy) forwardTo(name string) upstream {
+	name = strings.ToLower(name)
+	if up := p.forwardRule(name); up != nil {
+		return up
+	}
+	if p.Discovery != nil {
+		if resolvers := p.Discovery.Lookup(name); len(resolvers) > 0 {
+			return dns53Upstream{addrs: resolvers}
+		}
+	}
+	return nil
+}
+
+// forwardRule returns the upstream of the rule matching name, or nil.
+func (p *Proxy) forwardRule(name string) upstream {
+	fw, _ := p.forwarding.Load().([]forwardRule)
+	if len(fw) == 0 {
+		return nil
+	}
+	var match *forwardRule
+	for i := range fw {
+		r := &fw[i]
+		if match != nil && len(r.suffix) <= len(match.suffix) {
+			continue
+		}
+		if matchSuffix(name, r.suffix) {
+			match = r
+		}
+	}
+	if match == nil {
+		return nil
+	}
+	return match.up
+}
+
+// normalizeSuffix returns domain as a lower-cased fqdn, without wildcard.
+func normalizeSuffix(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimPrefix(domain, "*")
+	domain = strings.Trim(domain, ".")
+	if domain == "" {
+		return ""
+	}
+	return domain + "."
+}
+
+// matchSuffix returns true if name is suffix or a subdomain of it. Both must
+// be lower-cased fqdns.
+func matchSuffix(name, suffix string) bool {
+	return name == suffix || strings.HasSuffix(name, "."+suffix)
+}
+
+// dns53Upstream sends queries to plain DNS servers, over UDP with fallback
+// on TCP for truncated responses.
+type dns53Upstream struct {
+	addrs []string
+
+	// resolvers, if set, returns the servers to use instead of addrs.
+	resolvers func() []string
+}
+
+func (u dns53Upstream) exchange(ctx context.Context, q []byte) (*response, string, error) {
+	addrs := u.addrs
+	if u.resolvers != nil {
+		addrs = u.resolvers()
+	}
+	var addr string
+	err := errNoResolver
+	for _, addr = range addrs {
+		var res []byte
+		if res, err = exchangeDNS53(ctx, addr, q); err == nil {
+			return &response{body: ioutil.NopCloser(bytes.NewReader(res)), maxAge: -1}, addr, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, addr, err
+}
+
+// exchangeDNS53 sends q to the DNS server at addr and returns its response.
+func exchangeDNS53(ctx context.Context, addr string, q []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, dns53Timeout)
+	defer cancel()
+	res, err := exchangeConn(ctx, "udp", addr, q)
+	if err == nil && isTruncated(res) {
+		res, err = exchangeConn(ctx, "tcp", addr, q)
+	}
+	return res, err
+}
+
+func exchangeConn(ctx context.Context, network, addr string, q []byte) ([]byte, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblock pending reads and writes.
+			_ = c.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	buf := make([]byte, maxMsgSize)
+	if network == "tcp" {
+		msg := make([]byte, 2+len(q))
+		binary.BigEndian.PutUint16(msg, uint16(len(q)))
+		copy(msg[2:], q)
+		if _, err := c.Write(msg); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return nil, err
+		}
+		n := int(binary.BigEndian.Uint16(buf))
+		if _, err := io.ReadFull(c, buf[:n]); err != nil {
+			return nil, err
+		}
+		if n < dnsHeaderLen || binary.BigEndian.Uint16(buf) != binary.BigEndian.Uint16(q) {
+			return nil, errInvalidMsg
+		}
+		return buf[:n], nil
+	}
+	if _, err := c.Write(q); err != nil {
+		return nil, err
+	}
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < dnsHeaderLen || binary.BigEndian.Uint16(buf) != binary.BigEndian.Uint16(q) {
+			// Ignore stray or spoofed responses.
+			continue
+		}
+		return buf[:n], nil
+	}
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/nextdns/windows/settings"
+)
+
+func TestSetForwardingRulesUpstream(t *testing.T) {
+	tests := []struct {
+		upstream string
+		ok       bool
+	}{
+		{settings.ForwardSystem, true},
+		{"10.0.0.1", true},
+		{"10.0.0.1:5353", true},
+		{"https://doh.corp.example/dns-query#10.0.0.1", true},
+		{"https://10.0.0.1/dns-query", true},
+		// The host would be resolved by the proxy.
+		{"https://doh.corp.example/dns-query", false},
+		{"dns.corp.example", false},
+	}
+	for _, tt := range tests {
+		p := &Proxy{}
+		err := p.SetForwardingRules([]settings.ForwardingRule{{Domain: "corp.example", Upstream: tt.upstream}})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.upstream, err)
+		}
+		if n := len(p.ForwardingRules()); (n == 1) != tt.ok {
+			t.Errorf("%s: %d rules set", tt.upstream, n)
+		}
+	}
+}
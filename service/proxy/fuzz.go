@@ -0,0 +1,25 @@
+// +build gofuzz
+
+package proxy
+
+// Fuzz is the go-fuzz entry point for the query parser.
+func Fuzz(data []byte) int {
+	qry, err := parseQuery(data)
+	if err == errNotQuery {
+		return 0
+	}
+	buf := make([]byte, 512)
+	if n := qry.writeError(buf, rcodeServerFailure, true, edeOther, "fuzz"); n > 0 && err == nil {
+		res, rerr := parseQuery(append([]byte(nil), buf[:n]...))
+		if rerr != errNotQuery || res.id != qry.id {
+			panic("error response is not a response to the query")
+		}
+	}
+	if err != nil {
+		return 0
+	}
+	if qry.name == "" || len(qry.question) == 0 {
+		panic("valid query without question")
+	}
+	return 1
+}
@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/nextdns/windows/settings"
+)
+
+const (
+	// DefaultLocalTTL is the TTL in seconds of the local records without TTL
+	// and of the hosts file entries.
+	DefaultLocalTTL = 60
+
+	// DefaultHostsInterval is the time between two checks of the hosts files
+	// for modifications.
+	DefaultHostsInterval = 2 * time.Second
+
+	// maxCNAMEChain is the maximum number of local CNAMEs followed to answer
+	// a query.
+	maxCNAMEChain = 8
+)
+
+// localRecord is a record of the local zone.
+type localRecord struct {
+	typ    uint16
+	ttl    uint32
+	rdata  []byte
+	target string // lower-cased fqdn of a CNAME target
+}
+
+// localZone maps lower-cased fqdns to their local records.
+type localZone map[string][]localRecord
+
+// SetLocalRecords sets the records answered locally instead of being resolved
+// upstream. They take precedence over the entries of the hosts files for the
+// same name. If a record is invalid, an error is returned and the current
+// records are kept.
+func (p *Proxy) SetLocalRecords(records []settings.LocalRecord) error {
+	z := localZone{}
+	for _, r := range records {
+		name := normalizeSuffix(r.Name)
+		if name == "" {
+			return fmt.Errorf("%s: invalid name", r.Name)
+		}
+		rec, err := newLocalRecord(r)
+		if err != nil {
+			return fmt.Errorf("%s: %v", r.Name, err)
+		}
+		z[name] = append(z[name], rec)
+		if len(z[name]) > 1 && hasCNAME(z[name]) {
+			return fmt.Errorf("%s: CNAME cannot coexist with other records", r.Name)
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.localRecords = append([]settings.LocalRecord(nil), records...)
+	p.staticZone = z
+	p.local.Store(mergeZones(p.staticZone, p.hostsZone))
+	return nil
+}
+
+// LocalRecords returns the current local records.
+func (p *Proxy) LocalRecords() []settings.LocalRecord {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]settings.LocalRecord(nil), p.localRecords...)
+}
+
+// SetHostsFiles sets the files in the hosts format whose entries are answered
+// locally. The files are reloaded when modified until SetHostsFiles is called
+// again. A missing file is treated as empty.
+func (p *Proxy) SetHostsFiles(paths []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if reflect.DeepEqual(paths, p.hostsFiles) {
+		return
+	}
+	if p.hostsStop != nil {
+		close(p.hostsStop)
+		p.hostsStop = nil
+	}
+	p.hostsFiles = append([]string(nil), paths...)
+	p.hostsZone = nil
+	p.local.Store(mergeZones(p.staticZone, p.hostsZone))
+	if len(paths) > 0 {
+		stop := make(chan struct{})
+		p.hostsStop = stop
+		go p.watchHosts(p.hostsFiles, stop)
+	}
+}
+
+// watchHosts loads the hosts files at paths, and reloads them when their size
+// or modification time change until stop is closed.
+func (p *Proxy) watchHosts(paths []string, stop chan struct{}) {
+	ticker := time.NewTicker(DefaultHostsInterval)
+	defer ticker.Stop()
+	type stamp struct {
+		size    int64
+		modTime time.Time
+	}
+	stamps := make([]stamp, len(paths))
+	for first := true; ; first = false {
+		changed := first
+		for i, path := range paths {
+			var st stamp
+			if fi, err := os.Stat(path); err == nil {
+				st = stamp{size: fi.Size(), modTime: fi.ModTime()}
+			}
+			if st != stamps[i] {
+				stamps[i] = st
+				changed = true
+			}
+		}
+		if changed {
+			z := localZone{}
+			for _, path := range paths {
+				if err := loadHosts(path, z); err != nil && !os.IsNotExist(err) {
+					p.logErr(fmt.Errorf("hosts: %v", err))
+				}
+			}
+			p.mu.Lock()
+			select {
+			case <-stop:
+				// Replaced while loading.
+				p.mu.Unlock()
+				return
+			default:
+			}
+			p.hostsZone = z
+			p.local.Store(mergeZones(p.staticZone, p.hostsZone))
+			p.mu.Unlock()
+			if !first {
+				p.logInfo(fmt.Sprintf("Reloaded hosts files: %d names", len(z)))
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// answerLocal writes into buf the response to qry if its name has local
+// records. It returns the size of the response and true if the query was
+// answered locally.
+func (p *Proxy) answerLocal(qry query, buf []byte) (int, bool) {
+	z, _ := p.local.Load().(localZone)
+	if len(z) == 0 || qry.qclass != classINET {
+		return -1, false
+	}
+	rrs, found := z[strings.ToLower(qry.name)]
+	if !found {
+		return -1, false
+	}
+	var answers []resourceRecord
+	owner := "" // The name of the question.
+	for i := 0; i < maxCNAMEChain; i++ {
+		var cname *localRecord
+		for j := range rrs {
+			r := &rrs[j]
+			switch {
+			case r.typ == qry.qtype || qry.qtype == typeANY:
+				answers = append(answers, resourceRecord{name: owner, typ: r.typ, ttl: r.ttl, rdata: r.rdata})
+			case r.typ == typeCNAME:
+				cname = r
+			}
+		}
+		if cname == nil {
+			break
+		}
+		answers = append(answers, resourceRecord{name: owner, typ: typeCNAME, ttl: cname.ttl, rdata: cname.rdata})
+		// Targets without local records are left to the client to resolve.
+		owner = cname.target
+		if rrs, found = z[owner]; !found {
+			break
+		}
+	}
+	// Names with records of other types only get an empty NOERROR response.
+	return qry.writeResponse(buf, rcodeSuccess, answers, nil), true
+}
+
+// newLocalRecord returns the localRecord of r.
+func newLocalRecord(r settings.LocalRecord) (localRecord, error) {
+	rec := localRecord{ttl: DefaultLocalTTL}
+	if r.TTL > 0 {
+		rec.ttl = uint32(r.TTL)
+	}
+	switch strings.ToUpper(r.Type) {
+	case "A":
+		ip := net.ParseIP(r.Value).To4()
+		if ip == nil {
+			return rec, fmt.Errorf("%s: invalid IPv4 address", r.Value)
+		}
+		rec.typ, rec.rdata = typeA, ip
+	case "AAAA":
+		ip := net.ParseIP(r.Value)
+		if ip == nil || ip.To4() != nil {
+			return rec, fmt.Errorf("%s: invalid IPv6 address", r.Value)
+		}
+		rec.typ, rec.rdata = typeAAAA, ip.To16()
+	case "CNAME", "PTR":
+		rec.typ = typeCNAME
+		if strings.ToUpper(r.Type) == "PTR" {
+			rec.typ = typePTR
+		}
+		rec.target = normalizeSuffix(r.Value)
+		var err error
+		if rec.rdata, err = appendName(nil, rec.target); err != nil || rec.target == "" {
+			return rec, fmt.Errorf("%s: invalid domain", r.Value)
+		}
+	default:
+		return rec, fmt.Errorf("%s: unsupported record type", r.Type)
+	}
+	return rec, nil
+}
+
+func hasCNAME(rrs []localRecord) bool {
+	for _, r := range rrs {
+		if r.typ == typeCNAME {
+			return true
+		}
+	}
+	return false
+}
+
+// loadHosts adds the entries of the hosts file at path to z.
+func loadHosts(path string, z localZone) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return parseHosts(f, z)
+}
+
+// parseHosts adds to z the A and AAAA records of the entries of the hosts
+// file r, and a PTR record to the first name of each entry. Invalid lines are
+// skipped.
+func parseHosts(r io.Reader, z localZone) error {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(strings.SplitN(fields[0], "%", 2)[0])
+		if ip == nil {
+			continue
+		}
+		rec := localRecord{typ: typeAAAA, ttl: DefaultLocalTTL, rdata: ip.To16()}
+		if ip4 := ip.To4(); ip4 != nil {
+			rec.typ, rec.rdata = typeA, ip4
+		}
+		var first string
+		for _, name := range fields[1:] {
+			name = normalizeSuffix(name)
+			if name == "" || hasCNAME(z[name]) {
+				continue
+			}
+			if _, err := appendName(nil, name); err != nil {
+				continue
+			}
+			if first == "" {
+				first = name
+			}
+			z[name] = append(z[name], rec)
+		}
+		if first == "" || ip.IsUnspecified() {
+			continue
+		}
+		ptr := reverseName(ip)
+		if _, found := z[ptr]; !found {
+			rdata, _ := appendName(nil, first)
+			z[ptr] = []localRecord{{typ: typePTR, ttl: DefaultLocalTTL, rdata: rdata}}
+		}
+	}
+	return s.Err()
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of ip.
+func reverseName(ip net.IP) string {
+	const hex = "0123456789abcdef"
+	var b strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "%d.", ip4[i])
+		}
+		b.WriteString("in-addr.arpa.")
+		return b.String()
+	}
+	ip = ip.To16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hex[ip[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hex[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
+
+// mergeZones returns the records of static, and those of hosts for the names
+// not in static.
+func mergeZones(static, hosts localZone) localZone {
+	z := make(localZone, len(static)+len(hosts))
+	for name, rrs := range hosts {
+		z[name] = rrs
+	}
+	for name, rrs := range static {
+		z[name] = rrs
+	}
+	return z
+}
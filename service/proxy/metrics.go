@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"time"
+)
+
+// Names of the metrics recorded in Proxy Metrics.
+const (
+	MetricQueriesReceived  = "nextdns_queries_received_total"
+	MetricQueriesAnswered  = "nextdns_queries_answered_total"
+	MetricQueriesFailed    = "nextdns_queries_failed_total"
+	MetricQueriesDeduped   = "nextdns_queries_deduped_total"
+	MetricQueriesShed      = "nextdns_queries_shed_total"
+	MetricQueryDuration    = "nextdns_query_duration_seconds"
+	MetricUpstreamDuration = "nextdns_upstream_request_duration_seconds"
+	MetricUpstreamErrors   = "nextdns_upstream_errors_total"
+	MetricEndpointSwitches = "nextdns_endpoint_switches_total"
+	MetricTunErrors        = "nextdns_tun_errors_total"
+)
+
+// countMetric increments the name counter with labels, if Metrics is set.
+func (p *Proxy) countMetric(name string, labels ...string) {
+	if p.Metrics != nil {
+		p.Metrics.Counter(name, metricHelp[name], labels...).Inc()
+	}
+}
+
+// observeMetric records d in the name histogram with labels, if Metrics is
+// set.
+func (p *Proxy) observeMetric(name string, d time.Duration, labels ...string) {
+	if p.Metrics != nil {
+		p.Metrics.Histogram(name, metricHelp[name], nil, labels...).Observe(d.Seconds())
+	}
+}
+
+var metricHelp = map[string]string{
+	MetricQueriesReceived:  "Queries received on the tun interface.",
+	MetricQueriesAnswered:  "Queries answered successfully, by source.",
+	MetricQueriesFailed:    "Queries answered with an error or not answered.",
+	MetricQueriesDeduped:   "Queries ignored as duplicates of a query being resolved.",
+	MetricQueriesShed:      "Queries refused or dropped because the queue was full.",
+	MetricQueryDuration:    "Time taken to answer queries, by source.",
+	MetricUpstreamDuration: "Time taken by successful upstream requests, by endpoint host or address.",
+	MetricUpstreamErrors:   "Failed upstream requests, by endpoint host or address.",
+	MetricEndpointSwitches: "Switches of the NextDNS endpoint used, by transport and endpoint.",
+	MetricTunErrors:        "Errors reading or writing packets on the tun interface.",
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+
+	"github.com/nextdns/windows/internal/dnsmsg"
+)
+
+const (
+	dnsHeaderLen = 12
+
+	// maxMsgSize is the maximum size of a DNS message.
+	maxMsgSize = 65535
+
+	typeA     = 1
+	typeCNAME = 5
+	typeSOA   = 6
+	typePTR   = 12
+	typeAAAA  = 28
+	typeOPT   = 41
+	typeANY   = 255
+
+	classINET = 1
+
+	rcodeSuccess       = 0
+	rcodeFormatError   = 1
+	rcodeServerFailure = 2
+	rcodeNameError     = 3
+	rcodeRefused       = 5
+
+	flagQR = 0x8000
+	flagAA = 0x0400
+	flagTC = 0x0200
+	flagRD = 0x0100
+	flagRA = 0x0080
+
+	opcodeQuery = 0
+
+	// Extended DNS Error option and info codes as defined by RFC 8914.
+	ednsOptionEDE      = 15
+	edeOther           = 0
+	edeNotSupported    = 21
+	edeNoReachableAuth = 22
+	edeNetworkError    = 23
+
+	ednsUDPSize = 1232
+)
+
+var errInvalidMsg = dnsmsg.ErrInvalidMsg
+
+// rrHeader is the fixed part of a resource record following its name.
+type rrHeader struct {
+	Type   uint16
+	Class  uint16
+	TTL    uint32
+	ttlOff int
+	rdata  []byte
+}
+
+// readRR parses the resource record starting at off and returns its header and
+// the offset of the next record.
+func readRR(msg []byte, off int) (rrHeader, int, error) {
+	var h rrHeader
+	off, err := dnsmsg.SkipName(msg, off)
+	if err != nil {
+		return h, -1, err
+	}
+	if off+10 > len(msg) {
+		return h, -1, errInvalidMsg
+	}
+	h.Type = binary.BigEndian.Uint16(msg[off:])
+	h.Class = binary.BigEndian.Uint16(msg[off+2:])
+	h.TTL = binary.BigEndian.Uint32(msg[off+4:])
+	h.ttlOff = off + 4
+	rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if off+rdlen > len(msg) {
+		return h, -1, errInvalidMsg
+	}
+	h.rdata = msg[off : off+rdlen]
+	return h, off + rdlen, nil
+}
+
+// agedTTLs subtracts age from the TTLs of the records of the msg response and
+// caps them to maxTTL if not negative. Invalid messages are left untouched.
+func agedTTLs(msg []byte, age, maxTTL int64) {
+	if len(msg) < dnsHeaderLen {
+		return
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+	off := dnsHeaderLen
+	for i := 0; i < qdcount; i++ {
+		var err error
+		if off, err = dnsmsg.SkipName(msg, off); err != nil || off+4 > len(msg) {
+			return
+		}
+		off += 4
+	}
+	var ttlOffs []int
+	for i := 0; i < rrcount; i++ {
+		var h rrHeader
+		var err error
+		if h, off, err = readRR(msg, off); err != nil {
+			return
+		}
+		if h.Type != typeOPT {
+			ttlOffs = append(ttlOffs, h.ttlOff)
+		}
+	}
+	for _, off := range ttlOffs {
+		ttl := int64(binary.BigEndian.Uint32(msg[off:])) - age
+		if ttl < 0 {
+			ttl = 0
+		}
+		if maxTTL >= 0 && ttl > maxTTL {
+			ttl = maxTTL
+		}
+		binary.BigEndian.PutUint32(msg[off:], uint32(ttl))
+	}
+}
+
+// resourceRecord is a record of a response synthesized by the proxy.
+type resourceRecord struct {
+	// name is the owner of the record as a fqdn. If empty, the record is
+	// owned by the name of the question.
+	name  string
+	typ   uint16
+	ttl   uint32
+	rdata []byte
+}
+
+// appendName appends the wire format of the name fqdn to b. Escaped
+// characters are not supported.
+func appendName(b []byte, name string) ([]byte, error) {
+	if name == "." {
+		return append(b, 0), nil
+	}
+	if len(name) > maxNameLen || !strings.HasSuffix(name, ".") || strings.Contains(name, "\\") {
+		return b, errInvalidMsg
+	}
+	for _, label := range strings.Split(name[:len(name)-1], ".") {
+		if len(label) == 0 || len(label) > maxLabelLen {
+			return b, errInvalidMsg
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+// readName returns the domain name starting at off in msg as a fqdn, following
+// compression pointers.
+func readName(msg []byte, off int) (string, error) {
+	var b strings.Builder
+	for hops := 0; ; {
+		if off >= len(msg) {
+			return "", errInvalidMsg
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if b.Len() == 0 {
+				return ".", nil
+			}
+			return b.String(), nil
+		case l&0xc0 == 0xc0:
+			if off+2 > len(msg) || hops > maxNameLen/2 {
+				return "", errInvalidMsg
+			}
+			hops++
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			continue
+		case l&0xc0 != 0 || off+1+l > len(msg):
+			return "", errInvalidMsg
+		}
+		b.Write(msg[off+1 : off+1+l])
+		b.WriteByte('.')
+		if b.Len() > maxNameLen {
+			return "", errInvalidMsg
+		}
+		off += 1 + l
+	}
+}
+
+// answerValues returns the addresses and names of the A, AAAA, CNAME and PTR
+// records of the answer section of the msg response. Other records are
+// skipped.
+func answerValues(msg []byte) []string {
+	if len(msg) < dnsHeaderLen {
+		return nil
+	}
+	off := dnsHeaderLen
+	var err error
+	for i := binary.BigEndian.Uint16(msg[4:]); i > 0; i-- {
+		if off, err = dnsmsg.SkipName(msg, off); err != nil || off+4 > len(msg) {
+			return nil
+		}
+		off += 4
+	}
+	var values []string
+	for i := binary.BigEndian.Uint16(msg[6:]); i > 0; i-- {
+		var h rrHeader
+		if h, off, err = readRR(msg, off); err != nil {
+			return values
+		}
+		switch h.Type {
+		case typeA, typeAAAA:
+			if len(h.rdata) == net.IPv4len || len(h.rdata) == net.IPv6len {
+				values = append(values, net.IP(h.rdata).String())
+			}
+		case typeCNAME, typePTR:
+			if name, err := readName(msg, off-len(h.rdata)); err == nil {
+				values = append(values, name)
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+
+	protoUDP = 17
+
+	defaultTTL = 64
+)
+
+var (
+	errShortPacket      = errors.New("packet too short")
+	errUnknownVersion   = errors.New("unknown IP version")
+	errNotUDP           = errors.New("not an UDP packet")
+	errFragmentedPacket = errors.New("fragmented packet")
+)
+
+// flow holds the addresses and ports of a datagram.
+type flow struct {
+	src, dst         net.IP
+	srcPort, dstPort uint16
+}
+
+// reply returns the flow of a response to a datagram of f.
+func (f flow) reply() flow {
+	return flow{
+		src:     f.dst,
+		dst:     f.src,
+		srcPort: f.dstPort,
+		dstPort: f.srcPort,
+	}
+}
+
+// isIPv6 returns true if f is an IPv6 flow.
+func (f flow) isIPv6() bool {
+	return f.src.To4() == nil
+}
+
+// ipHeaderLen returns the size of the IP header written for f.
+func (f flow) ipHeaderLen() int {
+	if f.isIPv6() {
+		return ipv6HeaderLen
+	}
+	return ipv4HeaderLen
+}
+
+// headerLen returns the size of the IP and UDP headers written by writeUDP
+// for f.
+func (f flow) headerLen() int {
+	return f.ipHeaderLen() + udpHeaderLen
+}
+
+// parseIP parses the IPv4 or IPv6 header of pkt. It returns the flow of the
+// packet with no ports, the transport protocol and its payload. The returned
+// flow does not reference pkt.
+func parseIP(pkt []byte) (flow, uint8, []byte, error) {
+	if len(pkt) < 1 {
+		return flow{}, 0, nil, errShortPacket
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		return parseIPv4(pkt)
+	case 6:
+		return parseIPv6(pkt)
+	default:
+		return flow{}, 0, nil, errUnknownVersion
+	}
+}
+
+func parseIPv4(pkt []byte) (flow, uint8, []byte, error) {
+	var f flow
+	if len(pkt) < ipv4HeaderLen {
+		return f, 0, nil, errShortPacket
+	}
+	ihl := int(pkt[0]&0xf) * 4
+	totalLen := int(binary.BigEndian.Uint16(pkt[2:]))
+	if ihl < ipv4HeaderLen || totalLen < ihl || totalLen > len(pkt) {
+		return f, 0, nil, errShortPacket
+	}
+	if binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 {
+		// More fragments flag or fragment offset set.
+		return f, 0, nil, errFragmentedPacket
+	}
+	f.src = append(net.IP(nil), pkt[12:16]...)
+	f.dst = append(net.IP(nil), pkt[16:20]...)
+	return f, pkt[9], pkt[ihl:totalLen], nil
+}
+
+func parseIPv6(pkt []byte) (flow, uint8, []byte, error) {
+	var f flow
+	if len(pkt) < ipv6HeaderLen {
+		return f, 0, nil, errShortPacket
+	}
+	payloadLen := int(binary.BigEndian.Uint16(pkt[4:]))
+	if ipv6HeaderLen+payloadLen > len(pkt) {
+		return f, 0, nil, errShortPacket
+	}
+	f.src = append(net.IP(nil), pkt[8:24]...)
+	f.dst = append(net.IP(nil), pkt[24:40]...)
+	// Extension headers are not supported, they are reported as the
+	// transport protocol.
+	return f, pkt[6], pkt[ipv6HeaderLen : ipv6HeaderLen+payloadLen], nil
+}
+
+// parseUDP parses the IPv4 or IPv6 and UDP headers of pkt. It returns the flow
+// of the datagram and its payload. The returned flow does not reference pkt.
+func parseUDP(pkt []byte) (flow, []byte, error) {
+	f, proto, seg, err := parseIP(pkt)
+	if err != nil {
+		return f, nil, err
+	}
+	if proto != protoUDP {
+		return f, nil, errNotUDP
+	}
+	return parseUDPHeader(f, seg)
+}
+
+func parseUDPHeader(f flow, seg []byte) (flow, []byte, error) {
+	if len(seg) < udpHeaderLen {
+		return f, nil, errShortPacket
+	}
+	f.srcPort = binary.BigEndian.Uint16(seg[0:])
+	f.dstPort = binary.BigEndian.Uint16(seg[2:])
+	udpLen := int(binary.BigEndian.Uint16(seg[4:]))
+	if udpLen < udpHeaderLen || udpLen > len(seg) {
+		return f, nil, errShortPacket
+	}
+	return f, seg[udpHeaderLen:udpLen], nil
+}
+
+// writeUDP writes the IP and UDP headers of a datagram of flow f at the start
+// of buf. The payload of n bytes must already be present in buf right after
+// the headers, at f.headerLen(). The returned slice holds the whole packet.
+func writeUDP(buf []byte, f flow, n int) []byte {
+	hlen := f.headerLen()
+	pkt := buf[:hlen+n]
+	iplen := f.ipHeaderLen()
+	writeIPHeader(pkt[:iplen], f, protoUDP, len(pkt)-iplen)
+
+	udp := pkt[iplen:]
+	binary.BigEndian.PutUint16(udp[0:], f.srcPort)
+	binary.BigEndian.PutUint16(udp[2:], f.dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	binary.BigEndian.PutUint16(udp[6:], 0)
+	sum := pseudoHeaderChecksum(f, protoUDP, len(udp))
+	csum := ^foldChecksum(checksum(sum, udp))
+	if csum == 0 {
+		// A zero checksum means no checksum for UDP.
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], csum)
+	return pkt
+}
+
+// writeIPHeader writes in ip the IPv4 or IPv6 header of a packet of flow f
+// carrying a payload of length bytes of the proto protocol.
+func writeIPHeader(ip []byte, f flow, proto uint8, length int) {
+	if f.isIPv6() {
+		binary.BigEndian.PutUint32(ip[0:], 6<<28) // No traffic class nor flow label
+		binary.BigEndian.PutUint16(ip[4:], uint16(length))
+		ip[6] = proto
+		ip[7] = defaultTTL
+		copy(ip[8:24], f.src)
+		copy(ip[24:40], f.dst)
+		return
+	}
+	ip[0] = 4<<4 | ipv4HeaderLen/4
+	ip[1] = 0 // TOS
+	binary.BigEndian.PutUint16(ip[2:], uint16(ipv4HeaderLen+length))
+	binary.BigEndian.PutUint16(ip[4:], 0)      // ID
+	binary.BigEndian.PutUint16(ip[6:], 0x4000) // Don't fragment
+	ip[8] = defaultTTL
+	ip[9] = proto
+	binary.BigEndian.PutUint16(ip[10:], 0)
+	copy(ip[12:16], f.src.To4())
+	copy(ip[16:20], f.dst.To4())
+	binary.BigEndian.PutUint16(ip[10:], ^foldChecksum(checksum(0, ip)))
+}
+
+// pseudoHeaderChecksum returns the partial checksum of the pseudo header used
+// by transport protocols checksums.
+func pseudoHeaderChecksum(f flow, proto uint8, length int) uint32 {
+	var sum uint32
+	if f.isIPv6() {
+		sum = checksum(0, f.src.To16())
+		sum = checksum(sum, f.dst.To16())
+	} else {
+		sum = checksum(0, f.src.To4())
+		sum = checksum(sum, f.dst.To4())
+	}
+	sum += uint32(proto)
+	sum += uint32(length)
+	return sum
+}
+
+// checksum adds b to the running one's complement sum.
+func checksum(sum uint32, b []byte) uint32 {
+	n := len(b)
+	for i := 0; i+1 < n; i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if n%2 == 1 {
+		sum += uint32(b[n-1]) << 8
+	}
+	return sum
+}
+
+// foldChecksum folds sum into 16 bits.
+func foldChecksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// queryPacket is a query for example.com A sent by 10.0.0.2:51234 to the
+// proxy, as read from the adapter.
+var queryPacket = []byte{
+	0x45, 0x00, 0x00, 0x39, 0x1c, 0x46, 0x00, 0x00, 0x80, 0x11, 0x52, 0x42,
+	0x0a, 0x00, 0x00, 0x02, 0xc0, 0x00, 0x02, 0x2a, 0xc8, 0x22, 0x00, 0x35,
+	0x00, 0x25, 0xf7, 0xf0, 0xa3, 0xc1, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x07, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65,
+	0x03, 0x63, 0x6f, 0x6d, 0x00, 0x00, 0x01, 0x00, 0x01,
+}
+
+// responsePacket is the response to queryPacket sent back by the proxy.
+var responsePacket = []byte{
+	0x45, 0x00, 0x00, 0x49, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11, 0x6e, 0x78,
+	0xc0, 0x00, 0x02, 0x2a, 0x0a, 0x00, 0x00, 0x02, 0x00, 0x35, 0xc8, 0x22,
+	0x00, 0x35, 0x5d, 0x58, 0xa3, 0xc1, 0x81, 0x80, 0x00, 0x01, 0x00, 0x01,
+	0x00, 0x00, 0x00, 0x00, 0x07, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65,
+	0x03, 0x63, 0x6f, 0x6d, 0x00, 0x00, 0x01, 0x00, 0x01, 0xc0, 0x0c, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2c, 0x00, 0x04, 0x5d, 0xb8, 0xd8,
+	0x22,
+}
+
+// checkChecksums checks the IPv4 header and UDP checksums of pkt.
+func checkChecksums(t *testing.T, pkt []byte) {
+	t.Helper()
+	if sum := foldChecksum(checksum(0, pkt[:ipv4HeaderLen])); sum != 0xffff {
+		t.Errorf("IPv4 header checksum %#04x does not verify", binary.BigEndian.Uint16(pkt[10:]))
+	}
+	f, _, seg, err := parseIP(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := foldChecksum(checksum(pseudoHeaderChecksum(f, protoUDP, len(seg)), seg)); sum != 0xffff {
+		t.Errorf("UDP checksum %#04x does not verify", binary.BigEndian.Uint16(seg[6:]))
+	}
+}
+
+func TestParseIPv4UDP(t *testing.T) {
+	// Frames on the adapter may be padded past the IP total length.
+	pkt := append(append([]byte(nil), queryPacket...), 0, 0, 0)
+	f, proto, seg, err := parseIP(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.src.Equal(net.IPv4(10, 0, 0, 2)) || !f.dst.Equal(net.ParseIP(ResolverIPv4)) {
+		t.Errorf("flow %v -> %v", f.src, f.dst)
+	}
+	if proto != protoUDP {
+		t.Errorf("proto = %d, want %d", proto, protoUDP)
+	}
+	if len(seg) != len(queryPacket)-ipv4HeaderLen {
+		t.Errorf("IP payload of %d bytes, want %d", len(seg), len(queryPacket)-ipv4HeaderLen)
+	}
+	f, payload, err := parseUDPHeader(f, seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.srcPort != 51234 || f.dstPort != 53 {
+		t.Errorf("ports %d -> %d", f.srcPort, f.dstPort)
+	}
+	if !bytes.Equal(payload, queryPacket[ipv4HeaderLen+udpHeaderLen:]) {
+		t.Errorf("UDP payload = %x", payload)
+	}
+	if qry, err := parseQuery(payload); err != nil || qry.name != "example.com." || qry.id != 0xa3c1 {
+		t.Errorf("query %q %#x (%v)", qry.name, qry.id, err)
+	}
+	checkChecksums(t, queryPacket)
+
+	// The flow does not reference the packet.
+	pkt[12] = 0
+	if !f.src.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Error("flow references the packet")
+	}
+}
+
+func TestParseIPv4Errors(t *testing.T) {
+	fragmented := append([]byte(nil), queryPacket...)
+	fragmented[6] |= 0x20 // More fragments
+	notUDP := append([]byte(nil), queryPacket...)
+	notUDP[9] = 6
+	tests := []struct {
+		name string
+		pkt  []byte
+		err  error
+	}{
+		{"empty", nil, errShortPacket},
+		{"short header", queryPacket[:ipv4HeaderLen-1], errShortPacket},
+		{"truncated", queryPacket[:len(queryPacket)-1], errShortPacket},
+		{"fragmented", fragmented, errFragmentedPacket},
+		{"not UDP", notUDP, errNotUDP},
+		{"unknown version", []byte{0x50}, errUnknownVersion},
+	}
+	for _, tt := range tests {
+		if _, _, err := parseUDP(tt.pkt); err != tt.err {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestWriteUDPv4(t *testing.T) {
+	f, payload, err := parseUDP(queryPacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf := f.reply()
+	res := responsePacket[ipv4HeaderLen+udpHeaderLen:]
+	buf := make([]byte, 512)
+	n := copy(buf[rf.headerLen():], res)
+	pkt := writeUDP(buf, rf, n)
+	if !bytes.Equal(pkt, responsePacket) {
+		t.Errorf("response packet\n got %x\nwant %x", pkt, responsePacket)
+	}
+	checkChecksums(t, pkt)
+
+	got, gotPayload, err := parseUDP(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.src.Equal(f.dst) || !got.dst.Equal(f.src) || got.srcPort != f.dstPort || got.dstPort != f.srcPort {
+		t.Errorf("reply flow %v:%d -> %v:%d", got.src, got.srcPort, got.dst, got.dstPort)
+	}
+	if !bytes.Equal(gotPayload[:2], payload[:2]) {
+		t.Errorf("response ID %x, want %x", gotPayload[:2], payload[:2])
+	}
+}
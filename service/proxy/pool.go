@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"sync/atomic"
+)
+
+const (
+	// DefaultMaxConcurrency defines the default value for Proxy
+	// MaxConcurrency.
+	DefaultMaxConcurrency = 100
+
+	// DefaultQueueSize defines the default value for Proxy QueueSize.
+	DefaultQueueSize = 500
+)
+
+// ShedPolicy defines how queries are shed when the queue of queries waiting
+// to be resolved is full.
+type ShedPolicy int
+
+const (
+	// ShedRefuse answers the new query with REFUSED.
+	ShedRefuse ShedPolicy = iota
+
+	// ShedDropOldest drops the oldest query of the queue to make room for
+	// the new one. The dropped query is not answered.
+	ShedDropOldest
+)
+
+// task is a query waiting for a worker.
+type task struct {
+	// do resolves the query and sends the response.
+	do func()
+
+	// shed is called instead of do when the query is shed. If refuse is
+	// true, the query must be answered with REFUSED.
+	shed func(refuse bool)
+}
+
+// workerPool resolves queries with a bounded number of goroutines, queuing
+// queries exceeding this limit in a bounded queue.
+type workerPool struct {
+	queue  chan task
+	policy ShedPolicy
+
+	inFlight *int64
+	shed     *uint64
+}
+
+// newWorkerPool starts workers goroutines resolving the tasks submitted to
+// the returned pool until stop is closed. The tasks still queued then are
+// shed according to policy. inFlight and shed are updated with the number of queries accepted
+// but not yet resolved and the number of shed queries.
+func newWorkerPool(workers, queueSize int, policy ShedPolicy, inFlight *int64, shed *uint64, stop <-chan struct{}) *workerPool {
+	if workers <= 0 {
+		workers = DefaultMaxConcurrency
+	}
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	wp := &workerPool{
+		queue:    make(chan task, queueSize),
+		policy:   policy,
+		inFlight: inFlight,
+		shed:     shed,
+	}
+	for i := 0; i < workers; i++ {
+		go wp.work(stop)
+	}
+	return wp
+}
+
+func (wp *workerPool) work(stop <-chan struct{}) {
+	for {
+		select {
+		case t := <-wp.queue:
+			t.do()
+			atomic.AddInt64(wp.inFlight, -1)
+		case <-stop:
+			wp.drain()
+			return
+		}
+	}
+}
+
+// drain sheds the queued tasks.
+func (wp *workerPool) drain() {
+	for {
+		select {
+		case t := <-wp.queue:
+			atomic.AddUint64(wp.shed, 1)
+			t.shed(wp.policy == ShedRefuse)
+			atomic.AddInt64(wp.inFlight, -1)
+		default:
+			return
+		}
+	}
+}
+
+// submit queues t for resolution, shedding a query according to the pool
+// policy if the queue is full.
+func (wp *workerPool) submit(t task) {
+	atomic.AddInt64(wp.inFlight, 1)
+	select {
+	case wp.queue <- t:
+		return
+	default:
+	}
+	atomic.AddUint64(wp.shed, 1)
+	if wp.policy == ShedDropOldest {
+		select {
+		case old := <-wp.queue:
+			atomic.AddInt64(wp.inFlight, -1)
+			old.shed(false)
+		default:
+		}
+		select {
+		case wp.queue <- t:
+			return
+		default:
+			// Queue filled again by a concurrent submit.
+			atomic.AddUint64(wp.shed, 1)
+			t.shed(false)
+		}
+	} else {
+		t.shed(true)
+	}
+	atomic.AddInt64(wp.inFlight, -1)
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// shedLog records the tasks shed by a pool.
+type shedLog struct {
+	mu      sync.Mutex
+	ids     []int
+	refused []bool
+}
+
+func (l *shedLog) task(id int, do func()) task {
+	return task{
+		do: do,
+		shed: func(refuse bool) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.ids = append(l.ids, id)
+			l.refused = append(l.refused, refuse)
+		},
+	}
+}
+
+func (l *shedLog) get() ([]int, []bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]int(nil), l.ids...), append([]bool(nil), l.refused...)
+}
+
+// fullPool returns a pool with a single busy worker and a full queue of
+// queueSize tasks numbered from 1. The worker resumes when block is closed.
+func fullPool(t *testing.T, policy ShedPolicy, queueSize int, l *shedLog, inFlight *int64, shed *uint64, stop chan struct{}) (wp *workerPool, block chan struct{}) {
+	t.Helper()
+	wp = newWorkerPool(1, queueSize, policy, inFlight, shed, stop)
+	block = make(chan struct{})
+	started := make(chan struct{})
+	wp.submit(l.task(0, func() {
+		close(started)
+		<-block
+	}))
+	<-started
+	for i := 1; i <= queueSize; i++ {
+		wp.submit(l.task(i, func() {}))
+	}
+	return wp, block
+}
+
+func TestWorkerPoolShedRefuse(t *testing.T) {
+	var l shedLog
+	var inFlight int64
+	var shed uint64
+	stop := make(chan struct{})
+	defer close(stop)
+	wp, block := fullPool(t, ShedRefuse, 2, &l, &inFlight, &shed, stop)
+	defer close(block)
+
+	wp.submit(l.task(3, func() { t.Error("refused task resolved") }))
+	ids, refused := l.get()
+	if len(ids) != 1 || ids[0] != 3 || !refused[0] {
+		t.Errorf("shed %v (refused %v), want the new task refused", ids, refused)
+	}
+	if got := atomic.LoadUint64(&shed); got != 1 {
+		t.Errorf("shed = %d, want 1", got)
+	}
+	if got := atomic.LoadInt64(&inFlight); got != 3 {
+		t.Errorf("inFlight = %d, want 3", got)
+	}
+}
+
+func TestWorkerPoolShedDropOldest(t *testing.T) {
+	var l shedLog
+	var inFlight int64
+	var shed uint64
+	stop := make(chan struct{})
+	defer close(stop)
+	wp, block := fullPool(t, ShedDropOldest, 2, &l, &inFlight, &shed, stop)
+
+	done := make(chan struct{})
+	wp.submit(l.task(3, func() { close(done) }))
+	ids, refused := l.get()
+	if len(ids) != 1 || ids[0] != 1 || refused[0] {
+		t.Errorf("shed %v (refused %v), want the oldest task dropped", ids, refused)
+	}
+	if got := atomic.LoadUint64(&shed); got != 1 {
+		t.Errorf("shed = %d, want 1", got)
+	}
+	if got := atomic.LoadInt64(&inFlight); got != 3 {
+		t.Errorf("inFlight = %d, want 3", got)
+	}
+	close(block)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("new task not resolved")
+	}
+}
+
+func TestWorkerPoolStop(t *testing.T) {
+	before := runtime.NumGoroutine()
+	var l shedLog
+	var inFlight int64
+	var shed uint64
+	stop := make(chan struct{})
+	_, block := fullPool(t, ShedRefuse, 5, &l, &inFlight, &shed, stop)
+	if got := atomic.LoadInt64(&inFlight); got != 6 {
+		t.Fatalf("inFlight = %d, want 6", got)
+	}
+	close(stop)
+	close(block)
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&inFlight) != 0 || runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("inFlight = %d, %d goroutines left", atomic.LoadInt64(&inFlight), runtime.NumGoroutine()-before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkerPoolDrain(t *testing.T) {
+	for _, policy := range []ShedPolicy{ShedRefuse, ShedDropOldest} {
+		var l shedLog
+		var inFlight int64
+		var shed uint64
+		// No workers: the tasks stay queued until drained.
+		wp := &workerPool{queue: make(chan task, 3), policy: policy, inFlight: &inFlight, shed: &shed}
+		for i := 0; i < 3; i++ {
+			wp.submit(l.task(i, func() { t.Error("drained task resolved") }))
+		}
+		wp.drain()
+		// The queued tasks are shed as when the queue is full.
+		ids, refused := l.get()
+		if len(ids) != 3 {
+			t.Errorf("policy %d: shed %v, want the 3 queued tasks", policy, ids)
+		}
+		for i, r := range refused {
+			if r != (policy == ShedRefuse) {
+				t.Errorf("policy %d: task %d refused = %v", policy, ids[i], r)
+			}
+		}
+		if got := atomic.LoadUint64(&shed); got != 3 {
+			t.Errorf("policy %d: shed = %d, want 3", policy, got)
+		}
+		if got := atomic.LoadInt64(&inFlight); got != 0 {
+			t.Errorf("policy %d: inFlight = %d, want 0", policy, got)
+		}
+	}
+}
@@ -4,18 +4,26 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nextdns/nextdns/resolver/endpoint"
+	"github.com/nextdns/windows/discovery"
+	"github.com/nextdns/windows/metrics"
+	"github.com/nextdns/windows/settings"
 	tun "github.com/nextdns/windows/tun"
 )
 
@@ -25,20 +33,173 @@ const (
 	StateStarted     = "started"
 	StateReasserting = "reasserting"
 	StateStopping    = "stopping"
+
+	// StateCaptive is the state of a started proxy forwarding the queries to
+	// the resolvers of the network because of a captive portal.
+	StateCaptive = "captive"
+
+	// StateFailOpen is the state of a started proxy forwarding the queries to
+	// the resolvers of the network because the upstream is unreachable.
+	StateFailOpen = "failopen"
+
+	// StateDegraded is the state of a started proxy resolving the queries
+	// with the secondary upstreams because NextDNS is unreachable.
+	StateDegraded = "degraded"
+)
+
+const (
+	// DefaultResolverIPv6 defines the default value for Proxy ResolverIPv6.
+	DefaultResolverIPv6 = "fd42:dead:beef::42"
+
+	// DefaultTimeout defines the default value for Proxy Timeout.
+	DefaultTimeout = 5 * time.Second
+
+	// ResolverIPv4 is the address announced as IPv4 DNS server on the tun
+	// interface, on which the proxy answers queries.
+	ResolverIPv4 = "192.0.2.42"
 )
 
+var (
+	// RouterIPs are the addresses of router.nextdns.io, the API selecting the
+	// best NextDNS endpoint, so it can be contacted without DNS.
+	RouterIPs = []string{
+		"216.239.32.21",
+		"216.239.34.21",
+		"216.239.36.21",
+		"216.239.38.21",
+	}
+
+	// AnycastEndpoints are the NextDNS anycast endpoints with their bootstrap
+	// IP, used when router.nextdns.io cannot be reached.
+	AnycastEndpoints = []string{
+		"https://dns1.nextdns.io#45.90.28.0",
+		"https://dns2.nextdns.io#45.90.30.0",
+	}
+
+	// FrontingEndpoint is the NextDNS endpoint fronted by a CDN, used when
+	// the anycast endpoints cannot be reached.
+	FrontingEndpoint = "https://d1xovudkxbl47e.cloudfront.net"
+)
+
+// nextdnsDoTIP is the anycast address of NextDNS used for DoT, the
+// configuration being identified by the server name.
+const nextdnsDoTIP = "45.90.28.0"
+
 type Proxy struct {
+	// Counters updated atomically, first to be 64-bit aligned on 32-bit
+	// platforms.
+	cacheHits    uint64
+	cacheMisses  uint64
+	inFlight     int64
+	shed         uint64
+	coalesced    uint64
+	retried      uint64
+	hedged       uint64
+	failingSince int64 // unix nano
+	dotFirst     int32
+	failovers    int32
+
+	upstreamFailures int32
+	captive          int32
+	probing          int32
+	failOpen         int32
+	degraded         int32
+
+	// Upstream is the DoH URL queries are sent to. Once started, Upstream,
+	// Transport, BackupTransport and DoT are changed with SetUpstream and
+	// SetDoTFallback, which switch the queries to the new ones at once.
 	Upstream string
 
 	ExtraHeaders http.Header
 
+	// OnStateChange is called on each state transition. The reason of the
+	// transition, if any, is returned by StateReason.
 	OnStateChange func(state string)
 
+	// OnCaptivePortal is called when a captive portal is detected with the
+	// URL of the portal, and when it is passed.
+	OnCaptivePortal func(captive bool, portalURL string)
+
 	// Transport is the http.RoundTripper used to perform DoH requests.
 	Transport http.RoundTripper
 
-	// QueryLog specifies an optional log function called for each received query.
-	QueryLog func(msgID uint16, qname string)
+	// Method is the HTTP method used for DoH requests, http.MethodPost or
+	// http.MethodGet. With GET, queries are sent with a message ID of 0 so
+	// the responses can be cached by HTTP intermediaries (RFC 8484). If empty,
+	// POST is used.
+	Method string
+
+	// BackupTransport is an optional http.RoundTripper connecting to other
+	// endpoints than Transport, used to retry failed requests and to hedge
+	// slow ones.
+	BackupTransport http.RoundTripper
+
+	// DoT is an optional DNS-over-TLS transport. Queries failing with DoH
+	// are sent with DoT and vice versa, the protocol used first switching
+	// after repeated failures.
+	DoT *DoTTransport
+
+	// PreferDoT sends queries with DoT first when DoT is set.
+	PreferDoT bool
+
+	// Discovery is an optional table of the DNS suffixes of the network
+	// adapters. Names under those suffixes are forwarded to the resolvers of
+	// their adapters, and the "system" forwarding upstream uses the resolvers
+	// of all adapters. It is started and stopped along with the proxy.
+	Discovery *discovery.Table
+
+	// HedgePercentile is the percentile of the latency of Transport (for
+	// instance 0.95) after which a request is also sent on BackupTransport,
+	// the first response being used. If zero, requests are not hedged.
+	HedgePercentile float64
+
+	// MaxExtraLoad is the maximum ratio of retried and hedged requests over
+	// the number of queries sent upstream. If zero, DefaultMaxExtraLoad is
+	// used.
+	MaxExtraLoad float64
+
+	// ResolverIPv6 is the address announced as IPv6 DNS server on the tun
+	// interface, on which the proxy answers queries sent over IPv6. If empty,
+	// DefaultResolverIPv6 is used.
+	ResolverIPv6 string
+
+	// ExtendedErrors adds an Extended DNS Error option (RFC 8914) with the
+	// reason of the failure to the error responses synthesized by the proxy
+	// for EDNS0 enabled queries.
+	ExtendedErrors bool
+
+	// MaxConcurrency is the maximum number of queries resolved concurrently.
+	// If zero, DefaultMaxConcurrency is used.
+	MaxConcurrency int
+
+	// QueueSize is the maximum number of queries waiting to be resolved when
+	// MaxConcurrency is reached. If zero, DefaultQueueSize is used.
+	QueueSize int
+
+	// ShedPolicy defines how queries are shed when the queue is full. The
+	// default is ShedRefuse.
+	ShedPolicy ShedPolicy
+
+	// Timeout is the maximum time allowed to resolve a query, including
+	// reading the response. Queries timing out are answered with SERVFAIL and
+	// reported with a TimeoutError. If zero, DefaultTimeout is used.
+	Timeout time.Duration
+
+	// CacheSize is the maximum number of responses kept in the local cache.
+	// If zero, DefaultCacheSize is used. If negative, caching is disabled.
+	CacheSize int
+
+	// CacheMaxTTL caps the time a response can be kept in the local cache. If
+	// zero, DefaultCacheMaxTTL is used.
+	CacheMaxTTL time.Duration
+
+	// QueryLog specifies an optional log function called for each answered
+	// query. It is called synchronously and must not block.
+	QueryLog func(QueryInfo)
+
+	// Metrics is an optional registry in which the activity of the proxy is
+	// recorded, under the Metric names.
+	Metrics *metrics.Registry
 
 	// ErrorLog specifies an optional log function for errors. If not set,
 	// errors are not reported.
@@ -46,16 +207,210 @@ type Proxy struct {
 
 	InfoLog func(string)
 
-	mu    sync.Mutex
-	tun   io.ReadWriteCloser
-	state string
-	stop  chan struct{}
+	mu        sync.Mutex
+	tun       io.ReadWriteCloser
+	state     string
+	stop      chan struct{}
+	upstream  settings.Upstream
+	customDoT bool // DoT was set by SetUpstream
+
+	dotFallback bool
+	nextdnsDoT  *DoTTransport // DoT set for a NextDNS configuration
+
+	stateReason atomic.Value // string
+
+	dedup    dedup
+	cache    cache
+	inflight coalescer
+
+	primaryStats   endpointStats
+	backupStats    endpointStats
+	dotStats       endpointStats
+	forwardStats   endpointStats
+	secondaryStats endpointStats
+	extra          extraBudget
+
+	upstreamSet atomic.Value // *upstreamSet
+
+	forwarding      atomic.Value // []forwardRule
+	forwardingRules []settings.ForwardingRule
+
+	local        atomic.Value // localZone
+	localRecords []settings.LocalRecord
+	staticZone   localZone
+	hostsZone    localZone
+	hostsFiles   []string
+	hostsStop    chan struct{}
+
+	special atomic.Value // specialPolicy
+
+	captiveDisabled bool
+	captiveProbeURL string
+	captiveURL      string
+
+	failOpenEnabled  bool
+	failOpenFailures int
+	failOpenAfter    time.Duration
+
+	secondary          atomic.Value // []upstream
+	secondaryUpstreams []string
+}
+
+// Sources of the responses reported in QueryInfo.
+const (
+	SourceLocal    = "local"
+	SourceCache    = "cache"
+	SourceUpstream = "upstream"
+)
+
+// QueryInfo describes a query reported to QueryLog.
+type QueryInfo struct {
+	ID   uint16
+	Time time.Time
+	Name string
+	Type uint16
+
+	// RCode is the response code of the response, or -1 if no response was
+	// sent.
+	RCode int
+
+	// Answers lists the addresses and names of the A, AAAA, CNAME and PTR
+	// records of the response.
+	Answers []string
+
+	// Source is SourceLocal, SourceCache or SourceUpstream.
+	Source string
+
+	// Upstream is the name of the endpoint which resolved the query, as
+	// reported in Stats. It is empty for the queries not sent upstream or
+	// sharing the response of an identical query.
+	Upstream string
+
+	// Latency is the time taken to answer the query.
+	Latency time.Duration
+}
+
+// Stats holds counters about the proxy activity.
+type Stats struct {
+	CacheHits    uint64
+	CacheMisses  uint64
+	CacheEntries int
+
+	// InFlight is the number of queries accepted but not yet answered.
+	InFlight int64
+	// Shed is the number of queries refused or dropped because the queue was
+	// full.
+	Shed uint64
+	// Coalesced is the number of queries answered with the response of an
+	// identical query resolved concurrently.
+	Coalesced uint64
+	// Retried is the number of failed requests retried on the backup
+	// endpoint.
+	Retried uint64
+	// Hedged is the number of slow requests also sent to the backup endpoint.
+	Hedged uint64
+
+	Endpoints []EndpointStats
+}
+
+// TimeoutError is the error reported when a query could not be resolved
+// within the Proxy Timeout.
+type TimeoutError struct {
+	Duration time.Duration
+}
 
-	dedup dedup
+func (e TimeoutError) Error() string {
+	return fmt.Sprintf("timeout after %v", e.Duration)
+}
+
+// Timeout returns true, making TimeoutError compatible with net.Error.
+func (e TimeoutError) Timeout() bool {
+	return true
 }
 
 func (p *Proxy) SetConfigID(id string) {
-	p.Upstream = "https://dns.nextdns.io/" + id
+	_ = p.SetUpstream(settings.Upstream{ConfigID: id})
+}
+
+// SetUpstream sets the server queries are sent to, either a NextDNS
+// configuration or a custom DoH or DoT server. A custom DoT server replaces
+// DoT. Custom servers must have a bootstrap IP or an IP as host. If the proxy
+// is running, new transports are used right away.
+func (p *Proxy) SetUpstream(u settings.Upstream) error {
+	if u.Custom() {
+		if err := checkBootstrap(u); err != nil {
+			return err
+		}
+	}
+	var dot *DoTTransport
+	if isDoT(u) {
+		var err error
+		if dot, err = customDoT(u); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var old *DoTTransport
+	if p.customDoT {
+		old, p.DoT = p.DoT, nil
+	}
+	p.customDoT = dot != nil
+	switch {
+	case dot != nil:
+		p.Upstream = ""
+		p.DoT = dot
+	case u.Custom():
+		p.Upstream = u.URL
+	default:
+		p.Upstream = "https://dns.nextdns.io/" + u.ConfigID
+	}
+	p.upstream = u
+	if p.stateLocked() != StateStopped {
+		p.setTransportsLocked()
+	} else {
+		p.publishUpstreamsLocked()
+	}
+	// Closed once no longer used by new queries.
+	if old != nil {
+		old.Close()
+	}
+	// Responses may differ from one upstream to another.
+	p.cache.flush()
+	return nil
+}
+
+// FlushCache removes all the responses stored in the local cache.
+func (p *Proxy) FlushCache() {
+	p.cache.flush()
+}
+
+// Stats returns the current proxy counters.
+func (p *Proxy) Stats() Stats {
+	st := Stats{
+		CacheHits:    atomic.LoadUint64(&p.cacheHits),
+		CacheMisses:  atomic.LoadUint64(&p.cacheMisses),
+		CacheEntries: p.cache.len(),
+		InFlight:     atomic.LoadInt64(&p.inFlight),
+		Shed:         atomic.LoadUint64(&p.shed),
+		Coalesced:    atomic.LoadUint64(&p.coalesced),
+		Retried:      atomic.LoadUint64(&p.retried),
+		Hedged:       atomic.LoadUint64(&p.hedged),
+		Endpoints: []EndpointStats{
+			p.primaryStats.stats("primary"),
+			p.backupStats.stats("backup"),
+		},
+	}
+	if p.upstreams().dot != nil {
+		st.Endpoints = append(st.Endpoints, p.dotStats.stats("dot"))
+	}
+	if fw, _ := p.forwarding.Load().([]forwardRule); len(fw) > 0 || p.Discovery != nil {
+		st.Endpoints = append(st.Endpoints, p.forwardStats.stats("forward"))
+	}
+	if ups, _ := p.secondary.Load().([]upstream); len(ups) > 0 {
+		st.Endpoints = append(st.Endpoints, p.secondaryStats.stats("secondary"))
+	}
+	return st
 }
 
 func (p *Proxy) SetDeviceInfo(name, model, id, version string) {
@@ -89,11 +444,23 @@ func (p *Proxy) stateLocked() string {
 	return p.state
 }
 
+// StateReason returns the reason of the last state transition, if any. It
+// can be called from OnStateChange.
+func (p *Proxy) StateReason() string {
+	reason, _ := p.stateReason.Load().(string)
+	return reason
+}
+
 func (p *Proxy) setStateLocked(s string) {
+	p.setStateReasonLocked(s, "")
+}
+
+func (p *Proxy) setStateReasonLocked(s, reason string) {
 	if p.state == s {
 		return
 	}
 	p.state = s
+	p.stateReason.Store(reason)
 	if p.OnStateChange != nil {
 		p.OnStateChange(s)
 	}
@@ -109,18 +476,103 @@ func (p *Proxy) Start() (err error) {
 	return p.startLocked()
 }
 
+func (p *Proxy) resolverIPv6() string {
+	if p.ResolverIPv6 != "" {
+		return p.ResolverIPv6
+	}
+	return DefaultResolverIPv6
+}
+
+func (p *Proxy) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	return DefaultTimeout
+}
+
 func (p *Proxy) startLocked() (err error) {
-	if p.tun, err = tun.OpenTunDevice("tun0", "192.0.2.43", "192.0.2.42", "255.255.255.0", []string{"192.0.2.42"}); err != nil {
+	if p.tun, err = tun.OpenTunDevice("tun0", "192.0.2.43", ResolverIPv4, "255.255.255.0", []string{ResolverIPv4, p.resolverIPv6()}); err != nil {
 		return err
 	}
-	p.Transport = p.nextdnsTransport()
-	go p.run()
+	p.setTransportsLocked()
+	if p.Discovery != nil {
+		p.Discovery.Start()
+	}
+	if p.PreferDoT {
+		atomic.StoreInt32(&p.dotFirst, 1)
+	} else {
+		atomic.StoreInt32(&p.dotFirst, 0)
+	}
+	p.cache.configure(p.CacheSize, p.CacheMaxTTL)
+	p.stop = make(chan struct{})
+	go p.run(p.stop)
 	return nil
 }
 
+// setTransportsLocked sets the DoH transports for the current upstream.
+func (p *Proxy) setTransportsLocked() {
+	switch {
+	case p.customDoT:
+		p.Transport = nil
+		p.BackupTransport = nil
+	case p.upstream.Custom():
+		p.Transport = customTransport(p.upstream)
+		p.BackupTransport = nil
+	default:
+		p.Transport = p.nextdnsTransport()
+		p.BackupTransport = p.backupTransport()
+	}
+	p.setNextDNSDoTLocked()
+}
+
+// SetDoTFallback enables or disables DoT along with DoH for NextDNS
+// configurations. When enabled, queries failing with DoH are sent to NextDNS
+// with DoT, for networks blocking DoH but allowing TCP port 853. If the proxy
+// is running, the change applies right away.
+func (p *Proxy) SetDoTFallback(enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dotFallback = enabled
+	if p.stateLocked() != StateStopped {
+		p.setNextDNSDoTLocked()
+	}
+}
+
+// setNextDNSDoTLocked sets DoT to the DoT endpoint of the current NextDNS
+// configuration if the DoT fallback is enabled, or removes it otherwise. DoT
+// is left untouched for custom upstreams or when set by the caller. The
+// resulting upstreams are published.
+func (p *Proxy) setNextDNSDoTLocked() {
+	old := p.nextdnsDoT
+	if old != nil && p.DoT == old {
+		p.DoT = nil
+	}
+	p.nextdnsDoT = nil
+	if p.dotFallback && !p.upstream.Custom() && p.DoT == nil {
+		host := "dns.nextdns.io"
+		if p.upstream.ConfigID != "" {
+			host = p.upstream.ConfigID + "." + host
+		}
+		if dot, err := ParseDoTURL(fmt.Sprintf("tls://%s#%s", host, nextdnsDoTIP)); err != nil {
+			p.logErr(err)
+		} else {
+			p.nextdnsDoT = dot
+			p.DoT = dot
+		}
+	}
+	p.publishUpstreamsLocked()
+	// Closed once no longer used by new queries.
+	if old != nil {
+		old.Close()
+	}
+}
+
 // nextdnsTransport returns a endpoint.Manager configured to connect to NextDNS
 // using different steering techniques.
 func (p *Proxy) nextdnsTransport() http.RoundTripper {
+	// Providers are tested in order until one works: the last endpoint fails
+	// only once all the providers did.
+	lastResort := endpoint.MustNew(FrontingEndpoint)
 	return &endpoint.Manager{
 		Providers: []endpoint.Provider{
 			// Prefer unicast routing.
@@ -128,30 +580,29 @@ func (p *Proxy) nextdnsTransport() http.RoundTripper {
 				SourceURL: "https://router.nextdns.io",
 				Client: &http.Client{
 					// Trick to avoid depending on DNS to contact the router API.
-					Transport: endpoint.MustNew(fmt.Sprintf("https://router.nextdns.io#%s", []string{
-						"216.239.32.21",
-						"216.239.34.21",
-						"216.239.36.21",
-						"216.239.38.21",
-					}[rand.Intn(3)])),
+					Transport: endpoint.MustNew(fmt.Sprintf("https://router.nextdns.io#%s", RouterIPs[rand.Intn(3)])),
 				},
 			},
 			// Fallback on anycast.
 			endpoint.StaticProvider([]*endpoint.Endpoint{
-				endpoint.MustNew("https://dns1.nextdns.io#45.90.28.0"),
-				endpoint.MustNew("https://dns2.nextdns.io#45.90.30.0"),
+				endpoint.MustNew(AnycastEndpoints[0]),
+				endpoint.MustNew(AnycastEndpoints[1]),
 			}),
 			// Fallback on CDN fronting.
 			endpoint.StaticProvider([]*endpoint.Endpoint{
-				endpoint.MustNew("https://d1xovudkxbl47e.cloudfront.net"),
+				lastResort,
 			}),
 		},
 		OnError: func(e *endpoint.Endpoint, err error) {
 			if p.ErrorLog != nil {
 				p.ErrorLog(fmt.Errorf("Endpoint failed: %s: %v", e.Hostname, err))
 			}
+			if e.Equal(lastResort) {
+				p.providersExhausted(err)
+			}
 		},
 		OnChange: func(e *endpoint.Endpoint) {
+			p.countMetric(MetricEndpointSwitches, "transport", "primary", "endpoint", e.Hostname)
 			if p.InfoLog != nil {
 				p.InfoLog(fmt.Sprintf("Switching endpoint: %s", e.Hostname))
 			}
@@ -159,6 +610,34 @@ func (p *Proxy) nextdnsTransport() http.RoundTripper {
 	}
 }
 
+// backupTransport returns a endpoint.Manager connecting to NextDNS anycast
+// endpoints in the reverse order of nextdnsTransport, so a different endpoint
+// than the primary one is selected in most cases.
+func (p *Proxy) backupTransport() http.RoundTripper {
+	return &endpoint.Manager{
+		Providers: []endpoint.Provider{
+			endpoint.StaticProvider([]*endpoint.Endpoint{
+				endpoint.MustNew(AnycastEndpoints[1]),
+				endpoint.MustNew(AnycastEndpoints[0]),
+			}),
+			endpoint.StaticProvider([]*endpoint.Endpoint{
+				endpoint.MustNew(FrontingEndpoint),
+			}),
+		},
+		OnError: func(e *endpoint.Endpoint, err error) {
+			if p.ErrorLog != nil {
+				p.ErrorLog(fmt.Errorf("Backup endpoint failed: %s: %v", e.Hostname, err))
+			}
+		},
+		OnChange: func(e *endpoint.Endpoint) {
+			p.countMetric(MetricEndpointSwitches, "transport", "backup", "endpoint", e.Hostname)
+			if p.InfoLog != nil {
+				p.InfoLog(fmt.Sprintf("Switching backup endpoint: %s", e.Hostname))
+			}
+		},
+	}
+}
+
 func (p *Proxy) Stop() (err error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -176,6 +655,14 @@ func (p *Proxy) Stop() (err error) {
 		p.stop = nil
 	}
 	p.Transport = nil
+	p.BackupTransport = nil
+	p.publishUpstreamsLocked()
+	if p.Discovery != nil {
+		p.Discovery.Stop()
+	}
+	if p.DoT != nil {
+		p.DoT.Close()
+	}
 	return err
 }
 
@@ -201,7 +688,8 @@ func (p *Proxy) restartOrStop() {
 	}
 }
 
-// doStart transitions to StateStarted. If the previous state wasn't
+// doStart transitions to StateStarted, or to the StateCaptive, StateFailOpen
+// or StateDegraded mode the proxy was in before a restart. If the previous state wasn't
 // StateStarting or StateReassessing, no transition happens and false is
 // returned.
 func (p *Proxy) doStart() bool {
@@ -209,19 +697,13 @@ func (p *Proxy) doStart() bool {
 	defer p.mu.Unlock()
 	switch p.stateLocked() {
 	case StateStarting, StateReasserting:
-		p.setStateLocked(StateStarted)
+		p.setStateReasonLocked(p.modeStateLocked(), p.StateReason())
 		return true
 	default:
 		return false
 	}
 }
 
-func (p *Proxy) logQuery(msgID uint16, qname string) {
-	if p.QueryLog != nil {
-		p.QueryLog(msgID, qname)
-	}
-}
-
 func (p *Proxy) logInfo(msg string) {
 	if p.InfoLog != nil {
 		p.InfoLog(msg)
@@ -233,19 +715,22 @@ func (p *Proxy) logErr(err error) {
 	}
 }
 
-func (p *Proxy) run() {
+// run handles the packets of the tun device until stop is closed.
+func (p *Proxy) run(stop chan struct{}) {
 	defer p.restartOrStop()
 
 	// Setup firewall rules to avoid DNS leaking.
 	// The process block forever and removes rules when killed.
-	// We thus kill it as soon as we stop the proxy.
+	// We thus kill it as soon as we stop the proxy. The same context bounds
+	// the queries being resolved so they are abandoned as well.
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	if err := p.unleak(ctx); err != nil {
 		p.logErr(fmt.Errorf("cannot start dnsunleak: %v", err))
 	}
 
-	// Start the loop handling UDP packets received on the tun interface.
+	// Start the loop handling UDP and TCP packets received on the tun
+	// interface.
 	const maxSize = 1500
 	bpool := sync.Pool{
 		New: func() interface{} {
@@ -253,8 +738,7 @@ func (p *Proxy) run() {
 			return &b
 		},
 	}
-	p.stop = make(chan struct{})
-	// Isolate the reads in a goroutine so we can decide to bail when p.stop is
+	// Isolate the reads in a goroutine so we can decide to bail when stop is
 	// closed, even if tun.Read keeps blocking. This is to make sure we stop
 	// dnsunleak and not leave the user with no DNS. This certainly hides a bug
 	// in the tun library.
@@ -273,6 +757,7 @@ func (p *Proxy) run() {
 			n, err := tun.Read(buf[:maxSize]) // make sure we resize it to its max size
 			if err != nil {
 				if err != io.EOF {
+					p.countMetric(MetricTunErrors, "op", "read")
 					p.logErr(fmt.Errorf("tun read err: %v", err))
 				}
 				return
@@ -280,7 +765,12 @@ func (p *Proxy) run() {
 			packetIn <- buf[:n]
 		}
 	}()
+	// outDone is closed when packets can no longer be written, so senders do
+	// not block, e.g. the workers shedding the queued queries when run
+	// returns.
+	outDone := make(chan struct{})
 	go func() {
+		defer close(outDone)
 		for {
 			var buf []byte
 			var more bool
@@ -289,10 +779,11 @@ func (p *Proxy) run() {
 				if !more {
 					return
 				}
-			case <-p.stop:
+			case <-stop:
 				return
 			}
 			if _, err := tun.Write(buf); err != nil {
+				p.countMetric(MetricTunErrors, "op", "write")
 				p.logErr(fmt.Errorf("tun write error: %v", err))
 				return
 			}
@@ -300,59 +791,273 @@ func (p *Proxy) run() {
 		}
 	}()
 
-	dnsIP := []byte{192, 0, 2, 42}
+	// The workers are stopped when run returns, stop being left open when
+	// the proxy restarts.
+	poolStop := make(chan struct{})
+	defer close(poolStop)
+	pool := newWorkerPool(p.MaxConcurrency, p.QueueSize, p.ShedPolicy, &p.inFlight, &p.shed, poolStop)
+	tcp := &tcpResponder{
+		mtu: maxSize,
+		send: func(f flow, seq, ack uint32, flags uint8, payload []byte) {
+			buf := *bpool.Get().(*[]byte)
+			n := copy(buf[f.ipHeaderLen()+tcpHeaderLen:maxSize], payload)
+			select {
+			case packetOut <- writeTCP(buf, f, seq, ack, flags, n):
+			case <-outDone:
+			}
+		},
+		dispatch: func(q []byte, reply func(res []byte)) {
+			qry, qerr := parseQuery(q)
+			if qerr == errNotQuery {
+				reply(nil)
+				return
+			}
+			p.countMetric(MetricQueriesReceived)
+			pool.submit(task{
+				do: func() {
+					qctx, qcancel := context.WithTimeout(ctx, p.timeout())
+					defer qcancel()
+					buf := make([]byte, maxTCPMsgSize)
+					n, err := p.respond(qctx, qry, qerr, buf)
+					p.logErr(err)
+					if n < 0 {
+						reply(nil)
+						return
+					}
+					reply(buf[:n])
+				},
+				shed: func(refuse bool) {
+					p.countMetric(MetricQueriesShed)
+					if !refuse {
+						reply(nil)
+						return
+					}
+					buf := make([]byte, maxSize)
+					n := qry.writeError(buf, rcodeRefused, p.ExtendedErrors, edeOther, "query shed")
+					if n < 0 {
+						reply(nil)
+						return
+					}
+					reply(buf[:n])
+				},
+			})
+		},
+	}
+	dnsIP := net.ParseIP(ResolverIPv4)
+	dnsIP6 := net.ParseIP(p.resolverIPv6())
 	for {
 		var buf []byte
 		var more bool
 		select {
 		case buf, more = <-packetIn:
-		case <-p.stop:
+		case <-stop:
 			return
 		}
 		if !more {
 			break
 		}
-		qsize := len(buf)
-		if qsize <= 20 {
+		f, proto, seg, err := parseIP(buf)
+		if err != nil || !(f.dst.Equal(dnsIP) || f.dst.Equal(dnsIP6)) {
+			// Skip packet not directed to us.
 			bpool.Put(&buf)
 			continue
 		}
-		if buf[9] != 17 {
-			// Not UDP
+		if proto == protoTCP {
+			if s, err := parseTCPHeader(f, seg); err == nil && s.dstPort == 53 {
+				tcp.handle(s)
+			}
 			bpool.Put(&buf)
 			continue
 		}
-		if !bytes.Equal(buf[16:20], dnsIP) {
-			// Skip packet not directed to us.
+		if proto != protoUDP {
 			bpool.Put(&buf)
 			continue
 		}
-		msgID := lazyMsgID(buf)
-		if p.dedup.IsDup(msgID) {
+		f, q, err := parseUDPHeader(f, seg)
+		if err != nil || f.dstPort != 53 {
+			bpool.Put(&buf)
+			continue
+		}
+		qry, qerr := parseQuery(q)
+		if qerr == errNotQuery {
+			bpool.Put(&buf)
+			continue
+		}
+		p.countMetric(MetricQueriesReceived)
+		if p.dedup.IsDup(f, qry) {
+			p.countMetric(MetricQueriesDeduped)
 			bpool.Put(&buf)
 			// Skip duplicated query.
 			continue
 		}
-		go func() {
-			qname := lazyQName(buf)
-			p.logQuery(msgID, qname)
-			res, err := p.resolve(buf)
-			if err != nil {
-				p.logErr(fmt.Errorf("resolve: %x %v", msgID, err))
-				return
+		rf := f.reply()
+		pool.submit(task{
+			do: func() {
+				qctx, qcancel := context.WithTimeout(ctx, p.timeout())
+				defer qcancel()
+				// The response is written right after the space reserved for
+				// the IP and UDP headers of the reply.
+				rsize, err := p.respond(qctx, qry, qerr, buf[rf.headerLen():maxSize])
+				p.logErr(err)
+				if rsize < 0 {
+					bpool.Put(&buf)
+					return
+				}
+				select {
+				case packetOut <- writeUDP(buf, rf, rsize):
+				case <-outDone:
+				}
+			},
+			shed: func(refuse bool) {
+				p.countMetric(MetricQueriesShed)
+				rsize := -1
+				if refuse {
+					rsize = qry.writeError(buf[rf.headerLen():maxSize], rcodeRefused, p.ExtendedErrors, edeOther, "query shed")
+				}
+				if rsize < 0 {
+					bpool.Put(&buf)
+					return
+				}
+				select {
+				case packetOut <- writeUDP(buf, rf, rsize):
+				case <-outDone:
+				}
+			},
+		})
+	}
+}
+
+// respond writes into buf the response to qry. perr is the error returned by
+// parseQuery for qry: invalid queries are answered with the corresponding
+// error code. Names with local records and special-use names are answered
+// without contacting the upstream. It returns the size of the response along
+// with the error that may have been answered. If no response could be written,
+// -1 is returned.
+func (p *Proxy) respond(ctx context.Context, qry query, perr error, buf []byte) (n int, err error) {
+	qi := QueryInfo{ID: qry.id, Time: time.Now(), Name: qry.name, Type: qry.qtype, Source: SourceLocal}
+	if p.QueryLog != nil {
+		defer func() {
+			qi.Latency = time.Since(qi.Time)
+			qi.RCode = -1
+			if n >= dnsHeaderLen {
+				qi.RCode = int(buf[3] & 0xf)
+				qi.Answers = answerValues(buf[:n])
 			}
-			buf = buf[:maxSize] // reset buf size to it's underlaying size
-			rsize, err := readDNSResponse(res, buf)
-			if err != nil {
-				p.logErr(fmt.Errorf("readDNSResponse: %v", err))
+			p.QueryLog(qi)
+		}()
+	}
+	if p.Metrics != nil {
+		defer func() {
+			p.observeMetric(MetricQueryDuration, time.Since(qi.Time), "source", qi.Source)
+			if n < 0 || err != nil {
+				p.countMetric(MetricQueriesFailed)
 				return
 			}
-			select {
-			case packetOut <- buf[:rsize]:
-			case <-p.stop:
-			}
+			p.countMetric(MetricQueriesAnswered, "source", qi.Source)
 		}()
 	}
+	if qerr, ok := perr.(queryError); ok {
+		return qry.writeError(buf, qerr.rcode, p.ExtendedErrors, qerr.ede, qerr.reason), perr
+	}
+	if n, ok := p.answerLocal(qry, buf); ok {
+		return n, nil
+	}
+	if n, ok := p.answerSpecial(qry, buf); ok {
+		return n, nil
+	}
+	return p.answer(ctx, qry, buf, &qi)
+}
+
+// answer resolves the qry query, from the cache when possible, and writes the
+// response into buf. It returns the size of the response. buf may overlap the
+// query message.
+//
+// When qry cannot be resolved before ctx is done, a SERVFAIL response is
+// written to buf and the error is returned along with its size. If no response
+// could be written, -1 is returned. The source of the response is reported in
+// qi.
+func (p *Proxy) answer(ctx context.Context, qry query, buf []byte, qi *QueryInfo) (int, error) {
+	key := newCacheKey(qry)
+	if n, found := p.cache.get(key, qry.id, buf); found {
+		atomic.AddUint64(&p.cacheHits, 1)
+		qi.Source = SourceCache
+		return n, nil
+	}
+	atomic.AddUint64(&p.cacheMisses, 1)
+	qi.Source = SourceUpstream
+	n, shared, err := p.inflight.do(ctx, key, qry, buf, func(buf []byte) (int, error) {
+		n, endpoint, err := p.resolveInto(ctx, qry, buf)
+		qi.Upstream = endpoint
+		return n, err
+	})
+	if err != nil {
+		err = p.ctxErr(ctx, err)
+		ede := uint16(edeNetworkError)
+		if _, ok := err.(TimeoutError); ok {
+			ede = edeNoReachableAuth
+		}
+		n := qry.writeError(buf, rcodeServerFailure, p.ExtendedErrors, ede, err.Error())
+		return n, fmt.Errorf("resolve: %x %w", qry.id, err)
+	}
+	if shared {
+		atomic.AddUint64(&p.coalesced, 1)
+	} else {
+		p.cache.set(key, buf[:n])
+	}
+	return n, nil
+}
+
+// resolveInto sends qry upstream and reads the response into buf. It returns
+// the size of the response and the name of the endpoint which answered.
+func (p *Proxy) resolveInto(ctx context.Context, qry query, buf []byte) (int, string, error) {
+	var res *response
+	var err error
+	up := p.forwardTo(qry.name)
+	if up == nil {
+		up = p.specialTo(qry.name, qry.qtype)
+	}
+	if up == nil && p.bypassed() {
+		up = dns53Upstream{resolvers: p.systemResolvers}
+	}
+	if up != nil {
+		res, err = p.exchange(ctx, up, &p.forwardStats, qry.msg)
+	} else {
+		res, err = p.resolveUpstream(ctx, qry.msg)
+		p.upstreamResult(err)
+	}
+	if err != nil {
+		return -1, "", err
+	}
+	defer res.body.Close()
+	n, err := readDNSResponse(res.body, buf)
+	if err != nil {
+		return -1, res.endpoint, fmt.Errorf("readDNSResponse: %v", err)
+	}
+	if n < dnsHeaderLen {
+		return -1, res.endpoint, errInvalidMsg
+	}
+	// Restore the ID of the query, sent as 0 in GET mode.
+	binary.BigEndian.PutUint16(buf, qry.id)
+	if res.age > 0 || res.maxAge >= 0 {
+		// Records can't outlive the remaining HTTP freshness lifetime.
+		maxTTL := res.maxAge
+		if maxTTL >= 0 {
+			maxTTL -= res.age
+			if maxTTL < 0 {
+				maxTTL = 0
+			}
+		}
+		agedTTLs(buf[:n], res.age, maxTTL)
+	}
+	return n, res.endpoint, nil
+}
+
+// ctxErr returns a TimeoutError in place of err if ctx deadline was exceeded.
+func (p *Proxy) ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return TimeoutError{Duration: p.timeout()}
+	}
+	return err
 }
 
 func (p *Proxy) unleak(ctx context.Context) error {
@@ -361,7 +1066,8 @@ func (p *Proxy) unleak(ctx context.Context) error {
 	// We thus kill it as soon as we stop the proxy.
 	ex, _ := os.Executable()
 	dnsunleakPath := filepath.Join(filepath.Dir(ex), "dnsunleak.exe")
-	cmd := exec.CommandContext(ctx, dnsunleakPath)
+	// The service is allowed to send DNS53 queries to forward them.
+	cmd := exec.CommandContext(ctx, dnsunleakPath, ex)
 	stdout, stdoutW := io.Pipe()
 	stdinR, stdin := io.Pipe()
 	cmd.Stdin = stdinR
@@ -385,30 +1091,147 @@ func (p *Proxy) unleak(ctx context.Context) error {
 	return cmd.Start()
 }
 
-func (p *Proxy) resolve(buf []byte) (io.ReadCloser, error) {
-	req, err := http.NewRequest("POST", p.Upstream, bytes.NewReader(buf))
+// response is a DNS response being received from upstream.
+type response struct {
+	body io.ReadCloser
+
+	// age is the time in seconds the response spent in HTTP caches.
+	age int64
+	// maxAge is the freshness lifetime of the response in seconds, or -1 if
+	// not specified.
+	maxAge int64
+
+	// endpoint is the name of the endpoint which sent the response.
+	endpoint string
+}
+
+// exchange sends the buf query to u and returns the response. The outcome is
+// recorded in s.
+func (p *Proxy) exchange(ctx context.Context, u upstream, s *endpointStats, buf []byte) (*response, error) {
+	start := time.Now()
+	res, addr, err := u.exchange(ctx, buf)
+	if ctx.Err() == context.Canceled {
+		// Abandoned request.
+		return res, err
+	}
+	d := time.Since(start)
+	s.observe(d, err)
 	if err != nil {
-		return nil, err
+		p.countMetric(MetricUpstreamErrors, "endpoint", addr)
+	} else {
+		p.observeMetric(MetricUpstreamDuration, d, "endpoint", addr)
+	}
+	if res != nil {
+		res.endpoint = p.endpointName(s)
+	}
+	return res, err
+}
+
+// endpointName returns the name of the endpoint measured by s, as reported in
+// Stats.
+func (p *Proxy) endpointName(s *endpointStats) string {
+	switch s {
+	case &p.primaryStats:
+		return "primary"
+	case &p.backupStats:
+		return "backup"
+	case &p.dotStats:
+		return "dot"
+	case &p.forwardStats:
+		return "forward"
+	case &p.secondaryStats:
+		return "secondary"
 	}
-	req.Header.Set("Content-Type", "application/dns-packet")
+	return ""
+}
+
+// roundTrip sends the buf query with DoH to url using rt, and returns the
+// response and the host of the server it was sent to.
+func (p *Proxy) roundTrip(ctx context.Context, rt http.RoundTripper, url string, buf []byte) (*response, string, error) {
+	var req *http.Request
+	var err error
+	if p.Method == http.MethodGet {
+		q := append([]byte(nil), buf...)
+		binary.BigEndian.PutUint16(q, 0)
+		sep := "?"
+		if strings.Contains(url, "?") {
+			sep = "&"
+		}
+		u := url + sep + "dns=" + base64.RawURLEncoding.EncodeToString(q)
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, "", err
+		}
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(buf))
+		if err != nil {
+			return nil, "", err
+		}
+		req.Header.Set("Content-Type", "application/dns-packet")
+	}
+	req.Header.Set("Accept", "application/dns-message")
 	for name, hdrs := range p.ExtraHeaders {
 		req.Header[name] = hdrs
 	}
-	rt := p.Transport
-	if rt == nil {
-		rt = http.DefaultTransport
-	}
 	res, err := rt.RoundTrip(req)
+	// The endpoint.Manager transports set the host of the endpoint they
+	// used in req.
+	host := req.Host
+	if host == "" {
+		host = req.URL.Hostname()
+	}
 	if err != nil {
-		return nil, err
+		return nil, host, err
 	}
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("error code: %d", res.StatusCode)
+		res.Body.Close()
+		return nil, host, fmt.Errorf("error code: %d", res.StatusCode)
+	}
+	if res.ContentLength > maxMsgSize {
+		res.Body.Close()
+		return nil, host, fmt.Errorf("response too large: %d bytes", res.ContentLength)
+	}
+	return &response{
+		body:   res.Body,
+		age:    headerAge(res.Header),
+		maxAge: headerMaxAge(res.Header),
+	}, host, nil
+}
+
+// headerAge returns the value of the Age header of h, or 0 if absent or
+// invalid.
+func headerAge(h http.Header) int64 {
+	age, err := strconv.ParseInt(strings.TrimSpace(h.Get("Age")), 10, 64)
+	if err != nil || age < 0 {
+		return 0
 	}
-	return res.Body, nil
+	return age
 }
 
+// headerMaxAge returns the max-age directive of the Cache-Control header of h,
+// or -1 if absent or invalid.
+func headerMaxAge(h http.Header) int64 {
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.TrimSpace(d)
+		if !strings.HasPrefix(strings.ToLower(d), "max-age=") {
+			continue
+		}
+		maxAge, err := strconv.ParseInt(d[len("max-age="):], 10, 64)
+		if err != nil || maxAge < 0 {
+			return -1
+		}
+		return maxAge
+	}
+	return -1
+}
+
+// readDNSResponse reads the DNS message from r into buf. At most maxMsgSize
+// bytes are read: if the response does not fit, it is truncated and its TC bit
+// is set.
 func readDNSResponse(r io.Reader, buf []byte) (int, error) {
+	if len(buf) > maxMsgSize {
+		buf = buf[:maxMsgSize]
+	}
 	var n int
 	for {
 		nn, err := r.Read(buf[n:])
@@ -426,29 +1249,3 @@ func readDNSResponse(r io.Reader, buf []byte) (int, error) {
 	}
 	return n, nil
 }
-
-// lazyMsgID parses the message ID from a DNS query wything trying to parse or
-// validate the whole query.
-func lazyMsgID(buf []byte) uint16 {
-	if len(buf) < 30 {
-		return 0
-	}
-	return uint16(buf[28])<<8 | uint16(buf[29])
-}
-
-// lazyQName parses the qname from a DNS query without trying to parse or
-// validate the whole query.
-func lazyQName(buf []byte) string {
-	qn := &strings.Builder{}
-	for n := 40; n <= len(buf) && buf[n] != 0; {
-		end := n + 1 + int(buf[n])
-		if end > len(buf) {
-			// invalid qname, stop parsing
-			break
-		}
-		qn.Write(buf[n+1 : end])
-		qn.WriteByte('.')
-		n = end
-	}
-	return qn.String()
-}
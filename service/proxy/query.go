@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxLabelLen = 63
+	maxNameLen  = 255
+)
+
+var errNotQuery = errors.New("not a DNS query")
+
+// queryError is a query validation error answered to the client with rcode.
+type queryError struct {
+	rcode  int
+	ede    uint16
+	reason string
+}
+
+func (e queryError) Error() string {
+	return e.reason
+}
+
+func formatError(reason string) queryError {
+	return queryError{rcode: rcodeFormatError, ede: edeOther, reason: reason}
+}
+
+// query is a parsed DNS query.
+type query struct {
+	id     uint16
+	flags  uint16
+	name   string // presentation format, fully qualified
+	qtype  uint16
+	qclass uint16
+
+	// opt is the EDNS0 OPT record of the query, nil if absent.
+	opt *ednsOpt
+
+	// question is the wire format question section, copied so it survives
+	// the query buffer being overwritten by the response.
+	question []byte
+
+	// msg is the raw query. It references the buffer passed to parseQuery.
+	msg []byte
+}
+
+// ednsOpt holds the content of an EDNS0 OPT record (RFC 6891).
+type ednsOpt struct {
+	udpSize  uint16
+	extRcode uint8
+	version  uint8
+	do       bool
+	options  []ednsOption
+}
+
+type ednsOption struct {
+	code uint16
+	data []byte
+}
+
+// parseQuery parses the header, the question and the OPT record of the msg
+// query with strict bounds checking.
+//
+// If msg cannot be answered, because it is too short or is not a query,
+// errNotQuery is returned. If msg is malformed or unsupported, a queryError is
+// returned with the parts of the query that could be parsed so it can be
+// answered with the error.
+func parseQuery(msg []byte) (query, error) {
+	qry := query{msg: msg}
+	if len(msg) < dnsHeaderLen {
+		return qry, errNotQuery
+	}
+	qry.id = binary.BigEndian.Uint16(msg[0:])
+	qry.flags = binary.BigEndian.Uint16(msg[2:])
+	if qry.flags&flagQR != 0 {
+		return qry, errNotQuery
+	}
+	if opcode := int(qry.flags>>11) & 0xf; opcode != opcodeQuery {
+		return qry, queryError{rcode: rcodeRefused, ede: edeNotSupported, reason: "unsupported opcode"}
+	}
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return qry, formatError("query must have exactly one question")
+	}
+	name, off, err := parseQName(msg, dnsHeaderLen)
+	if err != nil {
+		return qry, err
+	}
+	if off+4 > len(msg) {
+		return qry, formatError("truncated question")
+	}
+	qry.name = name
+	qry.qtype = binary.BigEndian.Uint16(msg[off:])
+	qry.qclass = binary.BigEndian.Uint16(msg[off+2:])
+	off += 4
+	qry.question = append([]byte(nil), msg[dnsHeaderLen:off]...)
+
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:]))
+	arcount := int(binary.BigEndian.Uint16(msg[10:]))
+	for i := 0; i < ancount+nscount+arcount; i++ {
+		rrOff := off
+		var h rrHeader
+		if h, off, err = readRR(msg, off); err != nil {
+			return qry, formatError("invalid resource record")
+		}
+		if i < ancount+nscount || h.Type != typeOPT {
+			continue
+		}
+		if qry.opt != nil {
+			return qry, formatError("multiple OPT records")
+		}
+		if msg[rrOff] != 0 {
+			return qry, formatError("OPT record owner must be root")
+		}
+		if qry.opt, err = parseOPT(h); err != nil {
+			return qry, err
+		}
+	}
+	if off != len(msg) {
+		return qry, formatError("trailing data after last record")
+	}
+	return qry, nil
+}
+
+// parseQName parses the uncompressed name at off in msg and returns it in
+// presentation format with the offset following it.
+func parseQName(msg []byte, off int) (string, int, error) {
+	var sb strings.Builder
+	wireLen := 0
+	for {
+		if off >= len(msg) {
+			return "", -1, formatError("truncated name")
+		}
+		l := int(msg[off])
+		off++
+		wireLen += 1 + l
+		if wireLen > maxNameLen {
+			return "", -1, formatError("name too long")
+		}
+		if l == 0 {
+			break
+		}
+		if l > maxLabelLen {
+			// Compression pointers have no reason to be in a question.
+			return "", -1, formatError("invalid label")
+		}
+		if off+l > len(msg) {
+			return "", -1, formatError("truncated name")
+		}
+		for _, c := range msg[off : off+l] {
+			switch {
+			case c == '.' || c == '\\':
+				sb.WriteByte('\\')
+				sb.WriteByte(c)
+			case c < '!' || c > '~':
+				sb.WriteByte('\\')
+				s := strconv.Itoa(int(c))
+				sb.WriteString("000"[len(s):])
+				sb.WriteString(s)
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		sb.WriteByte('.')
+		off += l
+	}
+	if sb.Len() == 0 {
+		return ".", off, nil
+	}
+	return sb.String(), off, nil
+}
+
+func parseOPT(h rrHeader) (*ednsOpt, error) {
+	opt := &ednsOpt{
+		udpSize:  h.Class,
+		extRcode: uint8(h.TTL >> 24),
+		version:  uint8(h.TTL >> 16),
+		do:       h.TTL&0x8000 != 0,
+	}
+	data := h.rdata
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, formatError("truncated EDNS0 option")
+		}
+		code := binary.BigEndian.Uint16(data[0:])
+		l := int(binary.BigEndian.Uint16(data[2:]))
+		if 4+l > len(data) {
+			return nil, formatError("truncated EDNS0 option")
+		}
+		opt.options = append(opt.options, ednsOption{code: code, data: data[4 : 4+l]})
+		data = data[4+l:]
+	}
+	return opt, nil
+}
+
+// writeError writes into buf a response to qry with rcode. If ede is true and
+// the query supports EDNS0, an Extended DNS Error option with code and reason
+// is added. It returns the size of the response, or -1 if buf is too small.
+func (qry query) writeError(buf []byte, rcode int, ede bool, code uint16, reason string) int {
+	n := dnsHeaderLen + len(qry.question)
+	withEDE := ede && qry.opt != nil
+	if withEDE {
+		n += 11 + 4 + 2 + len(reason)
+	}
+	if n > len(buf) {
+		return -1
+	}
+	binary.BigEndian.PutUint16(buf[0:], qry.id)
+	flags := flagQR | qry.flags&0x7800 | qry.flags&flagRD | flagRA | uint16(rcode)
+	binary.BigEndian.PutUint16(buf[2:], flags)
+	qdcount := 0
+	if len(qry.question) > 0 {
+		qdcount = 1
+	}
+	binary.BigEndian.PutUint16(buf[4:], uint16(qdcount))
+	binary.BigEndian.PutUint16(buf[6:], 0)
+	binary.BigEndian.PutUint16(buf[8:], 0)
+	binary.BigEndian.PutUint16(buf[10:], 0)
+	off := dnsHeaderLen + copy(buf[dnsHeaderLen:], qry.question)
+	if !withEDE {
+		return off
+	}
+	binary.BigEndian.PutUint16(buf[10:], 1)
+	buf[off] = 0 // Root name
+	binary.BigEndian.PutUint16(buf[off+1:], typeOPT)
+	binary.BigEndian.PutUint16(buf[off+3:], ednsUDPSize)
+	binary.BigEndian.PutUint32(buf[off+5:], 0)
+	binary.BigEndian.PutUint16(buf[off+9:], uint16(4+2+len(reason)))
+	off += 11
+	binary.BigEndian.PutUint16(buf[off:], ednsOptionEDE)
+	binary.BigEndian.PutUint16(buf[off+2:], uint16(2+len(reason)))
+	binary.BigEndian.PutUint16(buf[off+4:], code)
+	off += 6
+	off += copy(buf[off:], reason)
+	return off
+}
+
+// writeResponse writes into buf an authoritative response to qry with rcode
+// and the answer and authority records. If the records do not fit into buf,
+// the response is truncated. It returns the size of the response, or -1 if
+// buf is too small or a record cannot be encoded.
+func (qry query) writeResponse(buf []byte, rcode int, answers, authority []resourceRecord) int {
+	if len(buf) < dnsHeaderLen+len(qry.question) {
+		return -1
+	}
+	msg := buf[:0]
+	msg = append(msg, make([]byte, dnsHeaderLen)...)
+	msg = append(msg, qry.question...)
+	flags := flagQR | flagAA | qry.flags&0x7800 | qry.flags&flagRD | flagRA | uint16(rcode)
+	binary.BigEndian.PutUint16(msg[0:], qry.id)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	var counts [2]int
+	for i, rrs := range [][]resourceRecord{answers, authority} {
+		for _, rr := range rrs {
+			var err error
+			if msg, err = appendRR(msg, rr); err != nil {
+				return -1
+			}
+			counts[i]++
+		}
+	}
+	if qry.opt != nil {
+		msg = append(msg, 0, typeOPT>>8, typeOPT&0xff, ednsUDPSize>>8, ednsUDPSize&0xff, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint16(msg[10:], 1)
+	}
+	if len(msg) > len(buf) {
+		// Appending went over buf: send the question only with TC set.
+		msg = buf[:dnsHeaderLen+len(qry.question)]
+		copy(msg[dnsHeaderLen:], qry.question)
+		flags |= flagTC
+		counts = [2]int{}
+		binary.BigEndian.PutUint16(msg[10:], 0)
+	}
+	binary.BigEndian.PutUint16(msg[0:], qry.id)
+	binary.BigEndian.PutUint16(msg[2:], flags)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[6:], uint16(counts[0]))
+	binary.BigEndian.PutUint16(msg[8:], uint16(counts[1]))
+	return len(msg)
+}
+
+// newQuery returns a recursive query message for name, a fqdn, and qtype with
+// a random ID.
+func newQuery(name string, qtype uint16) ([]byte, error) {
+	q := make([]byte, dnsHeaderLen, 512)
+	binary.BigEndian.PutUint16(q[0:], uint16(rand.Intn(0x10000)))
+	binary.BigEndian.PutUint16(q[2:], flagRD)
+	binary.BigEndian.PutUint16(q[4:], 1)
+	q, err := appendName(q, name)
+	if err != nil {
+		return nil, err
+	}
+	return append(q, byte(qtype>>8), byte(qtype), 0, classINET), nil
+}
+
+// appendRR appends the wire format of rr to msg, the name of the question
+// being compressed.
+func appendRR(msg []byte, rr resourceRecord) ([]byte, error) {
+	if rr.name == "" {
+		msg = append(msg, 0xc0, dnsHeaderLen) // Pointer to the question name.
+	} else {
+		var err error
+		if msg, err = appendName(msg, rr.name); err != nil {
+			return msg, err
+		}
+	}
+	var hdr [10]byte
+	binary.BigEndian.PutUint16(hdr[0:], rr.typ)
+	binary.BigEndian.PutUint16(hdr[2:], classINET)
+	binary.BigEndian.PutUint32(hdr[4:], rr.ttl)
+	binary.BigEndian.PutUint16(hdr[8:], uint16(len(rr.rdata)))
+	msg = append(msg, hdr[:]...)
+	return append(msg, rr.rdata...), nil
+}
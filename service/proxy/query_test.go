@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/nextdns/windows/internal/dnsmsg"
+	"github.com/nextdns/windows/settings"
+)
+
+// ednsQuery returns a query for name and qtype with an OPT record.
+func ednsQuery(t *testing.T, name string, qtype uint16) []byte {
+	t.Helper()
+	q, err := newQuery(name, qtype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint16(q[10:], 1)
+	return append(q, 0, typeOPT>>8, typeOPT&0xff, 0x10, 0x00, 0, 0, 0, 0, 0, 0)
+}
+
+// checkOPTResponse parses the msg response with readRR and checks that it
+// holds answers records followed by a single valid OPT record.
+func checkOPTResponse(t *testing.T, msg []byte, answers int) {
+	t.Helper()
+	if got := int(binary.BigEndian.Uint16(msg[6:])); got != answers {
+		t.Fatalf("ANCOUNT = %d, want %d", got, answers)
+	}
+	if got := binary.BigEndian.Uint16(msg[10:]); got != 1 {
+		t.Fatalf("ARCOUNT = %d, want 1", got)
+	}
+	off, err := dnsmsg.SkipName(msg, dnsHeaderLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off += 4
+	for i := 0; i < answers; i++ {
+		if _, off, err = readRR(msg, off); err != nil {
+			t.Fatalf("answer %d: %v", i, err)
+		}
+	}
+	optOff := off
+	h, off, err := readRR(msg, off)
+	if err != nil {
+		t.Fatalf("OPT: %v", err)
+	}
+	if msg[optOff] != 0 {
+		t.Errorf("OPT owner = %d, want root", msg[optOff])
+	}
+	if h.Type != typeOPT {
+		t.Errorf("OPT TYPE = %d, want %d", h.Type, typeOPT)
+	}
+	if h.Class != ednsUDPSize {
+		t.Errorf("OPT CLASS = %d, want %d", h.Class, ednsUDPSize)
+	}
+	if h.TTL != 0 || len(h.rdata) != 0 {
+		t.Errorf("OPT TTL = %d, RDLEN = %d, want 0, 0", h.TTL, len(h.rdata))
+	}
+	if off != len(msg) {
+		t.Errorf("%d trailing bytes", len(msg)-off)
+	}
+}
+
+func TestWriteResponseOPT(t *testing.T) {
+	qry, err := parseQuery(ednsQuery(t, "example.com.", typeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n := qry.writeResponse(buf, rcodeSuccess, []resourceRecord{
+		{typ: typeA, ttl: 60, rdata: net.IPv4(192, 0, 2, 1).To4()},
+	}, nil)
+	if n < 0 {
+		t.Fatal("writeResponse failed")
+	}
+	checkOPTResponse(t, buf[:n], 1)
+}
+
+func TestAnswerLocalOPT(t *testing.T) {
+	p := &Proxy{}
+	err := p.SetLocalRecords([]settings.LocalRecord{
+		{Name: "nas.home", Type: "A", Value: "192.168.1.2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qry, err := parseQuery(ednsQuery(t, "nas.home.", typeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n, ok := p.answerLocal(qry, buf)
+	if !ok || n < 0 {
+		t.Fatalf("answerLocal = %d, %v", n, ok)
+	}
+	checkOPTResponse(t, buf[:n], 1)
+}
+
+func TestParseQueryFormatError(t *testing.T) {
+	header := func(arcount uint16) []byte {
+		h := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(h[10:], arcount)
+		return h
+	}
+	question := func(name ...byte) []byte {
+		return append(name, 0, typeA, 0, 1)
+	}
+	opt := []byte{0, typeOPT >> 8, typeOPT & 0xff, 0x10, 0x00, 0, 0, 0, 0, 0, 0}
+	longLabel := append([]byte{64}, bytes.Repeat([]byte{'a'}, 64)...)
+
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{"truncated name", append(header(0), 7, 'e', 'x', 'a', 'm')},
+		{"unterminated name", append(header(0), 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e')},
+		{"truncated question", append(header(0), 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0, 0, typeA)},
+		{"compression loop", append(header(0), question(0xc0, dnsHeaderLen)...)},
+		{"compression pointer", append(header(0), question(1, 'a', 0xc0, dnsHeaderLen)...)},
+		{"label over 63 bytes", append(header(0), question(append(longLabel, 0)...)...)},
+		{"multiple OPT", append(append(append(header(2), question(0)...), opt...), opt...)},
+		{"truncated OPT", append(append(header(1), question(0)...), opt[:len(opt)-1]...)},
+		{"missing OPT", append(header(1), question(0)...)},
+		{"trailing data", append(append(header(0), question(0)...), 0)},
+		{"trailing data after OPT", append(append(append(header(1), question(0)...), opt...), 0)},
+	}
+	for _, tt := range tests {
+		_, err := parseQuery(tt.msg)
+		if qerr, ok := err.(queryError); !ok || qerr.rcode != rcodeFormatError {
+			t.Errorf("%s: err = %v, want FORMERR", tt.name, err)
+		}
+	}
+}
+
+func TestParseQueryTruncated(t *testing.T) {
+	msg := ednsQuery(t, "www.example.com.", typeAAAA)
+	if _, err := parseQuery(msg); err != nil {
+		t.Fatal(err)
+	}
+	for n := dnsHeaderLen; n < len(msg); n++ {
+		_, err := parseQuery(msg[:n])
+		if qerr, ok := err.(queryError); !ok || qerr.rcode != rcodeFormatError {
+			t.Errorf("%d bytes: err = %v, want FORMERR", n, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nextdns/windows/settings"
+)
+
+// SetSecondaryUpstreams sets the DoH servers used in StateDegraded, when
+// NextDNS cannot be reached through any of its endpoints, that is when the
+// endpoint manager tested all its providers without finding a working one.
+// Servers are tried in order. As their host cannot be resolved through the
+// proxy, they must have a bootstrap IP or an IP as host. If a server is
+// invalid, an error is returned and the current servers are kept.
+func (p *Proxy) SetSecondaryUpstreams(upstreams []string) error {
+	var ups []upstream
+	for _, s := range upstreams {
+		u, err := settings.ParseUpstream(s)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(u.URL, "https://") {
+			return fmt.Errorf("%s: only DoH servers are supported", s)
+		}
+		if err := checkBootstrap(u); err != nil {
+			return err
+		}
+		ups = append(ups, dohUpstream{p: p, rt: customTransport(u), url: u.URL})
+	}
+	p.mu.Lock()
+	p.secondaryUpstreams = append([]string(nil), upstreams...)
+	p.mu.Unlock()
+	p.secondary.Store(ups)
+	if len(ups) == 0 {
+		p.leaveDegraded("no secondary upstream")
+	}
+	return nil
+}
+
+// SecondaryUpstreams returns the current secondary upstreams.
+func (p *Proxy) SecondaryUpstreams() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.secondaryUpstreams...)
+}
+
+// resolveUpstream resolves q with NextDNS, or with the secondary upstreams in
+// StateDegraded.
+func (p *Proxy) resolveUpstream(ctx context.Context, q []byte) (*response, error) {
+	if atomic.LoadInt32(&p.degraded) == 1 {
+		return p.resolveSecondary(ctx, q)
+	}
+	return p.resolve(ctx, q)
+}
+
+// resolveSecondary resolves q with the first secondary upstream answering.
+func (p *Proxy) resolveSecondary(ctx context.Context, q []byte) (*response, error) {
+	ups, _ := p.secondary.Load().([]upstream)
+	err := errNoResolver
+	for _, up := range ups {
+		var res *response
+		if res, err = p.exchange(ctx, up, &p.secondaryStats, q); err == nil {
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// providersExhausted switches to StateDegraded after the NextDNS endpoint
+// manager failed with all its providers, the last error being err.
+func (p *Proxy) providersExhausted(err error) {
+	if state := p.State(); state == StateStopping || state == StateStopped {
+		return
+	}
+	p.enterDegraded(fmt.Sprintf("all NextDNS endpoints failed: %v", err))
+}
+
+// enterDegraded switches to StateDegraded for reason if secondary upstreams
+// are set, and checks NextDNS until it recovers.
+func (p *Proxy) enterDegraded(reason string) bool {
+	if ups, _ := p.secondary.Load().([]upstream); len(ups) == 0 {
+		return false
+	}
+	p.mu.Lock()
+	if !atomic.CompareAndSwapInt32(&p.degraded, 0, 1) {
+		p.mu.Unlock()
+		return false
+	}
+	p.updateModeStateLocked(reason)
+	p.mu.Unlock()
+	atomic.StoreInt32(&p.upstreamFailures, 0)
+	p.logInfo(fmt.Sprintf("Switching to secondary upstreams: %s", reason))
+	go p.watchDegraded()
+	return true
+}
+
+// leaveDegraded switches back from StateDegraded for reason.
+func (p *Proxy) leaveDegraded(reason string) {
+	p.mu.Lock()
+	if !atomic.CompareAndSwapInt32(&p.degraded, 1, 0) {
+		p.mu.Unlock()
+		return
+	}
+	p.updateModeStateLocked(reason)
+	p.mu.Unlock()
+	atomic.StoreInt32(&p.upstreamFailures, 0)
+	// Responses of the secondary upstreams are not filtered by NextDNS.
+	p.cache.flush()
+	p.logInfo(fmt.Sprintf("Switching back to NextDNS: %s", reason))
+}
+
+// watchDegraded resolves a name with NextDNS every DefaultRecoveryInterval
+// until it succeeds or the proxy is stopped.
+func (p *Proxy) watchDegraded() {
+	q, err := newQuery(recoveryProbeName, typeA)
+	if err != nil {
+		return
+	}
+	for atomic.LoadInt32(&p.degraded) == 1 {
+		time.Sleep(DefaultRecoveryInterval)
+		if state := p.State(); state == StateStopping || state == StateStopped {
+			p.leaveDegraded("proxy stopped")
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), p.timeout())
+		res, err := p.resolve(ctx, q)
+		if err == nil {
+			res.body.Close()
+		}
+		cancel()
+		if err == nil {
+			p.leaveDegraded("NextDNS recovered")
+			return
+		}
+	}
+}
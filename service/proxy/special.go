@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/nextdns/windows/settings"
+)
+
+// specialAction is how a category of special-use names is resolved.
+type specialAction int
+
+const (
+	specialAnswer specialAction = iota
+	specialForward
+	specialSystem
+)
+
+// specialKind is how special-use names are answered locally.
+type specialKind int
+
+const (
+	// specialNXDomain answers NXDOMAIN for all the names of the zone.
+	specialNXDomain specialKind = iota
+	// specialLoopback answers the loopback addresses for all the names of the
+	// zone, as specified by RFC 6761 for localhost.
+	specialLoopback
+	// specialEmptyZone answers as an authoritative server of an empty zone,
+	// as specified by RFC 6303.
+	specialEmptyZone
+)
+
+// specialPolicy holds the action of each category of special-use names.
+type specialPolicy struct {
+	local          specialAction
+	localhost      specialAction
+	invalid        specialAction
+	singleLabel    specialAction
+	privateReverse specialAction
+}
+
+// specialMatch is the category matched by a special-use name.
+type specialMatch struct {
+	zone   string // lower-cased fqdn, empty for single-label names
+	kind   specialKind
+	action specialAction
+}
+
+// privateReverseZones are the reverse zones of the private and link-local
+// address ranges, served empty by RFC 6303.
+var privateReverseZones = func() []string {
+	zones := []string{"10.in-addr.arpa.", "168.192.in-addr.arpa.", "254.169.in-addr.arpa."}
+	for i := 16; i < 32; i++ {
+		zones = append(zones, fmt.Sprintf("%d.172.in-addr.arpa.", i))
+	}
+	return append(zones, "d.f.ip6.arpa.", "8.e.f.ip6.arpa.", "9.e.f.ip6.arpa.", "a.e.f.ip6.arpa.", "b.e.f.ip6.arpa.")
+}()
+
+// SetSpecialUse sets how each category of special-use names (RFC 6761) and
+// reverse lookups of private addresses (RFC 6303) are resolved. By default,
+// they are all answered locally. If an action is invalid, an error is returned
+// and the current policy is kept.
+func (p *Proxy) SetSpecialUse(s settings.SpecialUse) error {
+	var sp specialPolicy
+	for _, c := range []struct {
+		name   string
+		value  string
+		action *specialAction
+	}{
+		{"local", s.Local, &sp.local},
+		{"localhost", s.Localhost, &sp.localhost},
+		{"invalid", s.Invalid, &sp.invalid},
+		{"singleLabel", s.SingleLabel, &sp.singleLabel},
+		{"privateReverse", s.PrivateReverse, &sp.privateReverse},
+	} {
+		switch c.value {
+		case "", settings.SpecialAnswer:
+			*c.action = specialAnswer
+		case settings.SpecialForward:
+			*c.action = specialForward
+		case settings.ForwardSystem:
+			*c.action = specialSystem
+		default:
+			return fmt.Errorf("%s: invalid action for %s", c.value, c.name)
+		}
+	}
+	if old, _ := p.special.Load().(specialPolicy); old != sp {
+		p.special.Store(sp)
+		// Cached responses may come from another upstream.
+		p.cache.flush()
+	}
+	return nil
+}
+
+// match returns the category of name, a lower-cased fqdn, queried for qtype if
+// it is a special-use name.
+func (sp specialPolicy) match(name string, qtype uint16) (specialMatch, bool) {
+	switch {
+	case matchSuffix(name, "localhost."):
+		return specialMatch{zone: "localhost.", kind: specialLoopback, action: sp.localhost}, true
+	case matchSuffix(name, "invalid."):
+		return specialMatch{zone: "invalid.", kind: specialNXDomain, action: sp.invalid}, true
+	case matchSuffix(name, "local."):
+		return specialMatch{zone: "local.", kind: specialNXDomain, action: sp.local}, true
+	}
+	if strings.HasSuffix(name, ".arpa.") {
+		for _, zone := range privateReverseZones {
+			if matchSuffix(name, zone) {
+				return specialMatch{zone: zone, kind: specialEmptyZone, action: sp.privateReverse}, true
+			}
+		}
+		return specialMatch{}, false
+	}
+	// Only host lookups are considered, single-label names being also TLDs
+	// for other types.
+	if strings.Count(name, ".") == 1 && name != "." &&
+		(qtype == typeA || qtype == typeAAAA || qtype == typeANY) {
+		return specialMatch{kind: specialNXDomain, action: sp.singleLabel}, true
+	}
+	return specialMatch{}, false
+}
+
+// specialTo returns the upstream to forward the query for name of type qtype
+// to if name is a special-use name sent to the resolvers of the network, or
+// nil.
+func (p *Proxy) specialTo(name string, qtype uint16) upstream {
+	sp, _ := p.special.Load().(specialPolicy)
+	if m, ok := sp.match(strings.ToLower(name), qtype); ok && m.action == specialSystem {
+		return dns53Upstream{resolvers: p.systemResolvers}
+	}
+	return nil
+}
+
+// answerSpecial writes into buf the response to qry if its name is a
+// special-use name to answer locally. Names matching a forwarding rule or a
+// discovered suffix, like an Active Directory domain under .local, are left to
+// their resolvers. It returns the size of the response and true if the query
+// was answered.
+func (p *Proxy) answerSpecial(qry query, buf []byte) (int, bool) {
+	if qry.qclass != classINET {
+		return -1, false
+	}
+	name := strings.ToLower(qry.name)
+	sp, _ := p.special.Load().(specialPolicy)
+	m, ok := sp.match(name, qry.qtype)
+	if !ok || m.action != specialAnswer || p.forwardTo(name) != nil {
+		return -1, false
+	}
+	var answers, authority []resourceRecord
+	rcode := rcodeNameError
+	switch m.kind {
+	case specialLoopback:
+		rcode = rcodeSuccess
+		if qry.qtype == typeA || qry.qtype == typeANY {
+			answers = append(answers, resourceRecord{typ: typeA, ttl: DefaultLocalTTL, rdata: []byte{127, 0, 0, 1}})
+		}
+		if qry.qtype == typeAAAA || qry.qtype == typeANY {
+			answers = append(answers, resourceRecord{typ: typeAAAA, ttl: DefaultLocalTTL, rdata: []byte{15: 1}})
+		}
+	case specialEmptyZone:
+		if name == m.zone {
+			rcode = rcodeSuccess
+			if qry.qtype == typeSOA || qry.qtype == typeANY {
+				soa := negativeSOA(m.zone)
+				soa.name = ""
+				answers = append(answers, soa)
+			}
+		}
+	}
+	if len(answers) == 0 && m.zone != "" {
+		// Let clients cache the negative response.
+		authority = append(authority, negativeSOA(m.zone))
+	}
+	return qry.writeResponse(buf, rcode, answers, authority), true
+}
+
+// negativeSOA returns the SOA record of the locally served zone, as
+// recommended by RFC 6303, with DefaultLocalTTL as negative TTL.
+func negativeSOA(zone string) resourceRecord {
+	rdata, _ := appendName(nil, zone)
+	rdata, _ = appendName(rdata, "nobody.invalid.")
+	var fields [20]byte
+	binary.BigEndian.PutUint32(fields[0:], 1)        // serial
+	binary.BigEndian.PutUint32(fields[4:], 604800)   // refresh
+	binary.BigEndian.PutUint32(fields[8:], 86400)    // retry
+	binary.BigEndian.PutUint32(fields[12:], 2419200) // expire
+	binary.BigEndian.PutUint32(fields[16:], DefaultLocalTTL)
+	return resourceRecord{name: zone, typ: typeSOA, ttl: DefaultLocalTTL, rdata: append(rdata, fields[:]...)}
+}
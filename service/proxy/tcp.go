@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	tcpHeaderLen = 20
+
+	protoTCP = 6
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	tcpWindow      = 65535
+	tcpDefaultMSS  = 536
+	tcpIdleTimeout = 30 * time.Second
+
+	// maxTCPMsgSize is the maximum size of a DNS message sent over TCP.
+	maxTCPMsgSize = 65535
+)
+
+// tcpSegment holds the parsed headers of a TCP segment.
+type tcpSegment struct {
+	flow
+	seq, ack uint32
+	flags    uint8
+	mss      int // MSS option, 0 if absent
+	payload  []byte
+}
+
+// parseTCPHeader parses the TCP header of seg, completing the f flow
+// returned by parseIP.
+func parseTCPHeader(f flow, seg []byte) (tcpSegment, error) {
+	s := tcpSegment{flow: f}
+	if len(seg) < tcpHeaderLen {
+		return s, errShortPacket
+	}
+	s.srcPort = binary.BigEndian.Uint16(seg[0:])
+	s.dstPort = binary.BigEndian.Uint16(seg[2:])
+	s.seq = binary.BigEndian.Uint32(seg[4:])
+	s.ack = binary.BigEndian.Uint32(seg[8:])
+	dataOff := int(seg[12]>>4) * 4
+	if dataOff < tcpHeaderLen || dataOff > len(seg) {
+		return s, errShortPacket
+	}
+	s.flags = seg[13]
+	opts := seg[tcpHeaderLen:dataOff]
+	for len(opts) > 0 {
+		kind := opts[0]
+		if kind == 0 { // End of options
+			break
+		}
+		if kind == 1 { // No-op
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			break
+		}
+		if kind == 2 && opts[1] == 4 { // Maximum segment size
+			s.mss = int(binary.BigEndian.Uint16(opts[2:]))
+		}
+		opts = opts[opts[1]:]
+	}
+	s.payload = seg[dataOff:]
+	return s, nil
+}
+
+// writeTCP writes the IP and TCP headers of a segment of flow f at the start
+// of buf. The payload of n bytes must already be present in buf right after
+// the headers, at f.ipHeaderLen()+tcpHeaderLen. The returned slice holds the
+// whole packet.
+func writeTCP(buf []byte, f flow, seq, ack uint32, flags uint8, n int) []byte {
+	iplen := f.ipHeaderLen()
+	pkt := buf[:iplen+tcpHeaderLen+n]
+	writeIPHeader(pkt[:iplen], f, protoTCP, len(pkt)-iplen)
+
+	tcp := pkt[iplen:]
+	binary.BigEndian.PutUint16(tcp[0:], f.srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], f.dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = tcpHeaderLen / 4 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], tcpWindow)
+	binary.BigEndian.PutUint16(tcp[16:], 0)
+	binary.BigEndian.PutUint16(tcp[18:], 0) // Urgent pointer
+	sum := pseudoHeaderChecksum(f, protoTCP, len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], ^foldChecksum(checksum(sum, tcp)))
+	return pkt
+}
+
+type tcpConnKey struct {
+	addr string
+	port uint16
+}
+
+type tcpConn struct {
+	f        flow // reply flow, from the proxy to the client
+	iss      uint32
+	sndNxt   uint32
+	rcvNxt   uint32
+	mss      int
+	in       []byte
+	pending  int
+	finRcvd  bool
+	finSent  bool
+	lastSeen time.Time
+}
+
+// tcpResponder is a minimal userspace TCP server answering the DNS queries
+// sent over TCP to the proxy, as stub resolvers do when receiving a truncated
+// response. As the tun interface is local, losses are not expected and
+// segments are never retransmitted. Only in order segments are accepted.
+type tcpResponder struct {
+	// send writes a segment of flow f to the tun interface.
+	send func(f flow, seq, ack uint32, flags uint8, payload []byte)
+
+	// dispatch resolves the q query and calls reply with the response, or
+	// with nil if the query is not answered. The reply function may be called
+	// from any goroutine.
+	dispatch func(q []byte, reply func(res []byte))
+
+	// mtu is the maximum size of the IP packets sent to the tun interface.
+	mtu int
+
+	mu    sync.Mutex
+	conns map[tcpConnKey]*tcpConn
+}
+
+// handle processes a segment received from the tun interface.
+func (t *tcpResponder) handle(seg tcpSegment) {
+	key := tcpConnKey{addr: seg.src.String(), port: seg.srcPort}
+	t.mu.Lock()
+	c, queries := t.handleLocked(key, seg)
+	t.mu.Unlock()
+	// Dispatch outside of the lock as reply may be called synchronously.
+	for _, q := range queries {
+		t.dispatch(q, func(res []byte) {
+			t.reply(key, c, res)
+		})
+	}
+}
+
+// handleLocked updates the connection state of key with seg and returns the
+// connection along with the complete queries it received.
+func (t *tcpResponder) handleLocked(key tcpConnKey, seg tcpSegment) (*tcpConn, [][]byte) {
+	now := time.Now()
+	c := t.conns[key]
+
+	if seg.flags&tcpRST != 0 {
+		delete(t.conns, key)
+		return nil, nil
+	}
+
+	if seg.flags&tcpSYN != 0 {
+		if c == nil {
+			t.expireLocked(now)
+			c = &tcpConn{
+				f:        seg.flow.reply(),
+				iss:      rand.Uint32(),
+				rcvNxt:   seg.seq + 1,
+				mss:      t.mss(seg),
+				lastSeen: now,
+			}
+			c.sndNxt = c.iss + 1
+			if t.conns == nil {
+				t.conns = map[tcpConnKey]*tcpConn{}
+			}
+			t.conns[key] = c
+		}
+		if seg.seq+1 == c.rcvNxt {
+			// New connection or retransmitted SYN.
+			t.send(c.f, c.iss, c.rcvNxt, tcpSYN|tcpACK, nil)
+		}
+		return nil, nil
+	}
+
+	if c == nil {
+		// Segment for an unknown connection.
+		if seg.flags&tcpACK != 0 {
+			t.send(seg.flow.reply(), seg.ack, 0, tcpRST, nil)
+		} else {
+			t.send(seg.flow.reply(), 0, seg.seq+uint32(len(seg.payload)), tcpRST|tcpACK, nil)
+		}
+		return nil, nil
+	}
+	c.lastSeen = now
+
+	if seg.seq != c.rcvNxt {
+		// Out of order or retransmitted segment, re-acknowledge what we have.
+		t.send(c.f, c.sndNxt, c.rcvNxt, tcpACK, nil)
+		return nil, nil
+	}
+	if c.finSent && seg.flags&tcpACK != 0 && seg.ack == c.sndNxt {
+		// Our FIN, only sent after the client's one, was acknowledged.
+		delete(t.conns, key)
+		return nil, nil
+	}
+	if len(seg.payload) == 0 && seg.flags&tcpFIN == 0 {
+		// Pure ACK.
+		return nil, nil
+	}
+	c.in = append(c.in, seg.payload...)
+	c.rcvNxt += uint32(len(seg.payload))
+	if seg.flags&tcpFIN != 0 {
+		c.rcvNxt++
+		c.finRcvd = true
+	}
+	t.send(c.f, c.sndNxt, c.rcvNxt, tcpACK, nil)
+
+	// Extract all the complete length-prefixed messages received.
+	var queries [][]byte
+	for len(c.in) >= 2 {
+		l := int(binary.BigEndian.Uint16(c.in))
+		if len(c.in) < 2+l {
+			break
+		}
+		queries = append(queries, append([]byte(nil), c.in[2:2+l]...))
+		c.in = c.in[2+l:]
+		c.pending++
+	}
+	if len(c.in) == 0 {
+		c.in = nil
+	}
+	t.closeIfDoneLocked(c)
+	return c, queries
+}
+
+// reply sends the res response on the c connection.
+func (t *tcpResponder) reply(key tcpConnKey, c *tcpConn, res []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c.pending--
+	if t.conns[key] != c {
+		// Connection reset or expired.
+		return
+	}
+	if len(res) > 0 {
+		msg := make([]byte, 2+len(res))
+		binary.BigEndian.PutUint16(msg, uint16(len(res)))
+		copy(msg[2:], res)
+		for len(msg) > 0 {
+			chunk := msg
+			if len(chunk) > c.mss {
+				chunk = chunk[:c.mss]
+			}
+			msg = msg[len(chunk):]
+			flags := uint8(tcpACK)
+			if len(msg) == 0 {
+				flags |= tcpPSH
+			}
+			t.send(c.f, c.sndNxt, c.rcvNxt, flags, chunk)
+			c.sndNxt += uint32(len(chunk))
+		}
+	}
+	t.closeIfDoneLocked(c)
+}
+
+// closeIfDoneLocked sends a FIN to the client once it closed its side of the
+// connection and all its queries were answered.
+func (t *tcpResponder) closeIfDoneLocked(c *tcpConn) {
+	if !c.finRcvd || c.finSent || c.pending > 0 {
+		return
+	}
+	t.send(c.f, c.sndNxt, c.rcvNxt, tcpFIN|tcpACK, nil)
+	c.sndNxt++
+	c.finSent = true
+}
+
+// mss returns the maximum payload size of the segments sent for the
+// connection opened by the syn segment.
+func (t *tcpResponder) mss(syn tcpSegment) int {
+	mss := syn.mss
+	if mss == 0 {
+		mss = tcpDefaultMSS
+	}
+	if limit := t.mtu - syn.flow.ipHeaderLen() - tcpHeaderLen; mss > limit {
+		mss = limit
+	}
+	return mss
+}
+
+// expireLocked drops the connections idle for more than tcpIdleTimeout.
+func (t *tcpResponder) expireLocked(now time.Time) {
+	for key, c := range t.conns {
+		if now.Sub(c.lastSeen) > tcpIdleTimeout {
+			delete(t.conns, key)
+		}
+	}
+}
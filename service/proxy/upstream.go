@@ -0,0 +1,351 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMaxExtraLoad defines the default value for Proxy MaxExtraLoad.
+	DefaultMaxExtraLoad = 0.1
+
+	// maxExtraBurst is the maximum number of retried or hedged requests that
+	// can be sent in a row once enough budget has been accumulated.
+	maxExtraBurst = 10
+
+	// latencySamples is the number of latest latencies kept per endpoint.
+	latencySamples = 256
+
+	// minHedgeSamples is the number of latencies to observe before hedging
+	// requests.
+	minHedgeSamples = 20
+
+	// failoverThreshold is the number of consecutive queries answered by the
+	// other protocol required to switch between DoH and DoT.
+	failoverThreshold = 3
+)
+
+// upstream sends queries to an upstream resolver.
+type upstream interface {
+	// exchange sends q and returns its response, and the host or address of
+	// the server it was sent to, if any.
+	exchange(ctx context.Context, q []byte) (*response, string, error)
+}
+
+// dohUpstream sends queries with DoH to url using rt.
+type dohUpstream struct {
+	p   *Proxy
+	rt  http.RoundTripper
+	url string
+}
+
+func (u dohUpstream) exchange(ctx context.Context, q []byte) (*response, string, error) {
+	return u.p.roundTrip(ctx, u.rt, u.url, q)
+}
+
+// EndpointStats holds the counters and latencies of an upstream endpoint.
+type EndpointStats struct {
+	Name     string
+	Requests uint64
+	Errors   uint64
+
+	// LatencyP50 and LatencyP95 are percentiles of the time taken by the
+	// latest successful requests to get a response.
+	LatencyP50 time.Duration
+	LatencyP95 time.Duration
+}
+
+// endpointStats tracks the requests sent to an upstream endpoint.
+type endpointStats struct {
+	mu       sync.Mutex
+	requests uint64
+	errors   uint64
+	samples  []time.Duration // ring of the latest latencies
+	next     int
+}
+
+// observe records the outcome of a request that took d.
+func (s *endpointStats) observe(d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if err != nil {
+		s.errors++
+		return
+	}
+	if len(s.samples) < latencySamples {
+		s.samples = append(s.samples, d)
+		return
+	}
+	s.samples[s.next] = d
+	s.next = (s.next + 1) % latencySamples
+}
+
+// percentile returns the q percentile (0 < q < 1) of the recorded latencies.
+// If less than min latencies were recorded, false is returned.
+func (s *endpointStats) percentile(q float64, min int) (time.Duration, bool) {
+	s.mu.Lock()
+	if len(s.samples) < min || len(s.samples) == 0 {
+		s.mu.Unlock()
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), s.samples...)
+	s.mu.Unlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(q*float64(len(sorted)-1))], true
+}
+
+func (s *endpointStats) stats(name string) EndpointStats {
+	st := EndpointStats{Name: name}
+	st.LatencyP50, _ = s.percentile(0.5, 1)
+	st.LatencyP95, _ = s.percentile(0.95, 1)
+	s.mu.Lock()
+	st.Requests = s.requests
+	st.Errors = s.errors
+	s.mu.Unlock()
+	return st
+}
+
+// extraBudget caps the load added upstream by retries and hedged requests.
+// Each query earns a fraction of an extra request, and each extra request
+// spends a whole one.
+type extraBudget struct {
+	mu     sync.Mutex
+	tokens float64
+}
+
+func (b *extraBudget) earn(ratio float64) {
+	b.mu.Lock()
+	b.tokens += ratio
+	if b.tokens > maxExtraBurst {
+		b.tokens = maxExtraBurst
+	}
+	b.mu.Unlock()
+}
+
+func (b *extraBudget) spend() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (p *Proxy) maxExtraLoad() float64 {
+	if p.MaxExtraLoad > 0 {
+		return p.MaxExtraLoad
+	}
+	return DefaultMaxExtraLoad
+}
+
+// hedgeDelay returns the time after which a request still waiting for the
+// primary endpoint is hedged on the backup one. If hedging is disabled or not
+// enough latencies were observed, false is returned.
+func (p *Proxy) hedgeDelay() (time.Duration, bool) {
+	if p.HedgePercentile <= 0 || p.HedgePercentile >= 1 {
+		return 0, false
+	}
+	return p.primaryStats.percentile(p.HedgePercentile, minHedgeSamples)
+}
+
+// upstreamSet holds the servers queries are sent to. It is replaced as a
+// whole when the upstream changes, so a query uses the URL and transports of
+// the same upstream.
+type upstreamSet struct {
+	url       string // DoH URL, empty when only DoT is used
+	transport http.RoundTripper
+	backup    http.RoundTripper
+	dot       *DoTTransport
+}
+
+// upstreams returns the current upstream set.
+func (p *Proxy) upstreams() *upstreamSet {
+	if ups, _ := p.upstreamSet.Load().(*upstreamSet); ups != nil {
+		return ups
+	}
+	// Not published yet, use the fields as set by the caller.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.newUpstreamSetLocked()
+}
+
+func (p *Proxy) newUpstreamSetLocked() *upstreamSet {
+	return &upstreamSet{
+		url:       p.Upstream,
+		transport: p.Transport,
+		backup:    p.BackupTransport,
+		dot:       p.DoT,
+	}
+}
+
+// publishUpstreamsLocked makes the queries use the current Upstream,
+// Transport, BackupTransport and DoT. Transports being replaced must only be
+// closed after this call.
+func (p *Proxy) publishUpstreamsLocked() {
+	p.upstreamSet.Store(p.newUpstreamSetLocked())
+}
+
+// resolve sends the buf query upstream and returns the response.
+//
+// When DoT is set, queries failing with one protocol are sent with the other
+// one, the preferred protocol switching after failoverThreshold consecutive
+// failovers.
+func (p *Proxy) resolve(ctx context.Context, buf []byte) (*response, error) {
+	ups := p.upstreams()
+	if ups.dot == nil {
+		return p.resolveDoH(ctx, ups, buf)
+	}
+	if ups.url == "" {
+		return p.resolveDoT(ctx, ups, buf)
+	}
+	dotFirst := atomic.LoadInt32(&p.dotFirst) == 1
+	first, second := p.resolveDoH, p.resolveDoT
+	if dotFirst {
+		first, second = second, first
+	}
+	res, err := first(ctx, ups, buf)
+	if err == nil {
+		atomic.StoreInt32(&p.failovers, 0)
+		return res, nil
+	}
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	res, err2 := second(ctx, ups, buf)
+	if err2 != nil {
+		return nil, err
+	}
+	if atomic.AddInt32(&p.failovers, 1) >= failoverThreshold {
+		atomic.StoreInt32(&p.failovers, 0)
+		if dotFirst {
+			atomic.StoreInt32(&p.dotFirst, 0)
+			p.logInfo("Switching to DoH")
+		} else {
+			atomic.StoreInt32(&p.dotFirst, 1)
+			p.logInfo("Switching to DoT")
+		}
+	}
+	return res, nil
+}
+
+func (p *Proxy) resolveDoT(ctx context.Context, ups *upstreamSet, buf []byte) (*response, error) {
+	return p.exchange(ctx, ups.dot, &p.dotStats, buf)
+}
+
+// resolveDoH sends the buf query with DoH and returns the response.
+//
+// When BackupTransport is set, a query failing on Transport is retried on it,
+// and a query taking longer than the HedgePercentile latency of Transport is
+// also sent to it, the first response being used. Those extra requests are
+// capped by MaxExtraLoad.
+func (p *Proxy) resolveDoH(ctx context.Context, ups *upstreamSet, buf []byte) (*response, error) {
+	rt := ups.transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	primary := dohUpstream{p: p, rt: rt, url: ups.url}
+	if ups.backup == nil {
+		return p.exchange(ctx, primary, &p.primaryStats, buf)
+	}
+	backup := dohUpstream{p: p, rt: ups.backup, url: ups.url}
+	p.extra.earn(p.maxExtraLoad())
+
+	// The response may be written over buf while a concurrent request is
+	// still sending it.
+	q := append([]byte(nil), buf...)
+
+	type result struct {
+		idx int
+		res *response
+		err error
+	}
+	results := make(chan result, 2)
+	var cancels []context.CancelFunc
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+	launch := func(u upstream, s *endpointStats) {
+		actx, cancel := context.WithCancel(ctx)
+		idx := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			res, err := p.exchange(actx, u, s, q)
+			results <- result{idx: idx, res: res, err: err}
+		}()
+	}
+
+	launch(primary, &p.primaryStats)
+	pending := 1
+	backupUsed := false
+	var hedge <-chan time.Time
+	if d, ok := p.hedgeDelay(); ok {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		hedge = t.C
+	}
+	var err error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Abandon the other request. Its cancellation is not
+				// counted as an error.
+				for i, cancel := range cancels {
+					if i != r.idx {
+						cancel()
+					}
+				}
+				if pending > 0 {
+					go func() {
+						if r := <-results; r.res != nil {
+							r.res.body.Close()
+						}
+					}()
+				}
+				// The body is still to be read: its request is canceled
+				// when closed rather than on return.
+				r.res.body = cancelOnClose{ReadCloser: r.res.body, cancel: cancels[r.idx]}
+				cancels[r.idx] = func() {}
+				return r.res, nil
+			}
+			err = r.err
+			if !backupUsed && ctx.Err() == nil && p.extra.spend() {
+				atomic.AddUint64(&p.retried, 1)
+				backupUsed = true
+				pending++
+				launch(backup, &p.backupStats)
+			}
+		case <-hedge:
+			if !backupUsed && p.extra.spend() {
+				atomic.AddUint64(&p.hedged, 1)
+				backupUsed = true
+				pending++
+				launch(backup, &p.backupStats)
+			}
+		}
+	}
+	return nil, err
+}
+
+// cancelOnClose is a response body canceling the context of its request when
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
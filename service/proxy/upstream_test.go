@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nextdns/windows/metrics"
+	"github.com/nextdns/windows/settings"
+)
+
+// roundTripFunc is an http.RoundTripper recording the context of its
+// requests.
+type roundTripFunc struct {
+	mu   sync.Mutex
+	ctxs []context.Context
+	fn   func(req *http.Request) (*http.Response, error)
+}
+
+func (rt *roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.ctxs = append(rt.ctxs, req.Context())
+	rt.mu.Unlock()
+	return rt.fn(req)
+}
+
+func (rt *roundTripFunc) contexts() []context.Context {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return append([]context.Context(nil), rt.ctxs...)
+}
+
+func failingTransport() *roundTripFunc {
+	return &roundTripFunc{fn: func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("unreachable")
+	}}
+}
+
+func TestResolveDoHCancelOnFailure(t *testing.T) {
+	primary, backup := failingTransport(), failingTransport()
+	p := &Proxy{
+		Upstream:        "https://doh.example/dns-query",
+		Transport:       primary,
+		BackupTransport: backup,
+		MaxExtraLoad:    1,
+	}
+	q, err := newQuery("example.com.", typeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.resolveDoH(context.Background(), p.upstreams(), q); err == nil {
+		t.Fatal("resolveDoH succeeded")
+	}
+	ctxs := append(primary.contexts(), backup.contexts()...)
+	if len(ctxs) != 2 {
+		t.Fatalf("%d requests, want 2", len(ctxs))
+	}
+	for i, ctx := range ctxs {
+		if ctx.Err() == nil {
+			t.Errorf("request %d context not canceled", i)
+		}
+	}
+}
+
+func TestResolveDoHCancelOnClose(t *testing.T) {
+	primary := &roundTripFunc{fn: func(*http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("response")),
+		}, nil
+	}}
+	p := &Proxy{
+		Upstream:        "https://doh.example/dns-query",
+		Transport:       primary,
+		BackupTransport: failingTransport(),
+	}
+	q, err := newQuery("example.com.", typeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.resolveDoH(context.Background(), p.upstreams(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := primary.contexts()[0]
+	// The body of the response is still readable.
+	if ctx.Err() != nil {
+		t.Fatal("request canceled before its body was read")
+	}
+	if b, err := ioutil.ReadAll(res.body); err != nil || string(b) != "response" {
+		t.Errorf("body = %q, %v", b, err)
+	}
+	res.body.Close()
+	if ctx.Err() == nil {
+		t.Error("request context not canceled once its body was closed")
+	}
+}
+
+func TestUpstreamMetricsEndpoint(t *testing.T) {
+	primary := &roundTripFunc{fn: func(req *http.Request) (*http.Response, error) {
+		// As the endpoint.Manager transports do.
+		req.URL.Host = "192.0.2.1:443"
+		req.Host = "dns1.nextdns.io"
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("response")),
+		}, nil
+	}}
+	p := &Proxy{
+		Upstream:  "https://dns.nextdns.io/abc123",
+		Transport: primary,
+		Metrics:   &metrics.Registry{},
+	}
+	q, err := newQuery("example.com.", typeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.resolveDoH(context.Background(), p.upstreams(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.body.Close()
+	if res.endpoint != "primary" {
+		t.Errorf("endpoint = %q, want primary", res.endpoint)
+	}
+	p.mu.Lock()
+	p.Transport = failingTransport()
+	p.publishUpstreamsLocked()
+	p.mu.Unlock()
+	if _, err := p.resolveDoH(context.Background(), p.upstreams(), q); err == nil {
+		t.Fatal("resolveDoH succeeded")
+	}
+
+	got := p.Metrics.String()
+	for _, want := range []string{
+		MetricUpstreamDuration + `_count{endpoint="dns1.nextdns.io"} 1`,
+		MetricUpstreamErrors + `{endpoint="dns.nextdns.io"} 1`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics missing %s:\n%s", want, got)
+		}
+	}
+}
+
+func TestSetUpstreamBootstrap(t *testing.T) {
+	tests := []struct {
+		conf string
+		ok   bool
+	}{
+		{"abc123", true},
+		{"https://doh.example/dns-query#192.0.2.1", true},
+		{"https://192.0.2.1/dns-query", true},
+		{"https://[2001:db8::1]/dns-query", true},
+		{"tls://dot.example#192.0.2.1", true},
+		{"https://doh.example/dns-query", false},
+		{"tls://dot.example", false},
+	}
+	for _, tt := range tests {
+		u, err := settings.ParseUpstream(tt.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &Proxy{}
+		if err := p.SetUpstream(u); (err == nil) != tt.ok {
+			t.Errorf("SetUpstream(%s) = %v", tt.conf, err)
+		}
+	}
+}
+
+func TestSetUpstreamConcurrentQueries(t *testing.T) {
+	p := &Proxy{}
+	dot, err := settings.ParseUpstream("tls://192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doh, err := settings.ParseUpstream("https://192.0.2.1/dns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := newQuery("example.com.", typeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Queries fail right away, only the access to the upstreams matters.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if res, err := p.resolve(ctx, q); err == nil {
+				res.body.Close()
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		u := doh
+		if i%2 == 0 {
+			u = dot
+		}
+		if err := p.SetUpstream(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
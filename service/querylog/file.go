@@ -0,0 +1,374 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// FormatJSONL writes one JSON object per line.
+	FormatJSONL = "jsonl"
+
+	// FormatCSV writes comma-separated values with a header line.
+	FormatCSV = "csv"
+)
+
+const (
+	// DefaultMaxSize defines the default value for FileWriter MaxSize.
+	DefaultMaxSize = 10 << 20
+
+	// DefaultMaxAge defines the default value for FileWriter MaxAge.
+	DefaultMaxAge = 24 * time.Hour
+
+	// DefaultMaxFiles defines the default value for FileWriter MaxFiles.
+	DefaultMaxFiles = 7
+
+	// filePrefix is the prefix of the names of the log files.
+	filePrefix = "queries-"
+
+	// fileTimeFormat is the format of the creation time in the names of the
+	// log files, sorting in chronological order.
+	fileTimeFormat = "20060102T150405.000000000"
+)
+
+var csvHeader = []string{"id", "time", "name", "type", "rcode", "answers", "source", "upstream", "latencyMs"}
+
+// FileWriter writes entries to files in Dir, switching to a new file when the
+// current one reaches MaxSize or MaxAge, and keeping the MaxFiles most recent
+// files.
+type FileWriter struct {
+	// Dir is the directory of the files. It is created if needed.
+	Dir string
+
+	// Format is FormatJSONL or FormatCSV. If empty, FormatJSONL is used.
+	Format string
+
+	// MaxSize is the size in bytes after which a new file is started. If
+	// zero, DefaultMaxSize is used.
+	MaxSize int64
+
+	// MaxAge is the age after which a new file is started. If zero,
+	// DefaultMaxAge is used.
+	MaxAge time.Duration
+
+	// MaxFiles is the number of files kept, including the current one. If
+	// zero, DefaultMaxFiles is used.
+	MaxFiles int
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	created time.Time
+}
+
+// Write appends e to the current file, rotating files as needed.
+func (fw *FileWriter) Write(e Entry) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.f != nil && (fw.size >= fw.maxSize() || time.Since(fw.created) >= fw.maxAge()) {
+		if err := fw.closeLocked(); err != nil {
+			return err
+		}
+	}
+	if fw.f == nil {
+		if err := fw.openLocked(); err != nil {
+			return err
+		}
+	}
+	b, err := encodeEntry(e, fw.format())
+	if err != nil {
+		return err
+	}
+	n, err := fw.w.Write(b)
+	fw.size += int64(n)
+	if err != nil {
+		return err
+	}
+	// Keep the file complete in case the service is killed.
+	return fw.w.Flush()
+}
+
+// Close closes the current file.
+func (fw *FileWriter) Close() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return fw.closeLocked()
+}
+
+// Entries returns the entries of the files of Dir between from and to, in any
+// format, the oldest first.
+func (fw *FileWriter) Entries(from, to time.Time) ([]Entry, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.w != nil {
+		if err := fw.w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	files, err := fw.filesLocked()
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, path := range files {
+		if entries, err = readFile(path, entries, from, to); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (fw *FileWriter) openLocked() error {
+	if err := os.MkdirAll(fw.Dir, 0755); err != nil {
+		return err
+	}
+	now := time.Now()
+	path := filepath.Join(fw.Dir, filePrefix+now.UTC().Format(fileTimeFormat)+"."+fw.format())
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	fw.f, fw.w, fw.size, fw.created = f, bufio.NewWriter(f), 0, now
+	if fw.format() == FormatCSV {
+		n, _ := fw.w.WriteString(strings.Join(csvHeader, ",") + "\n")
+		fw.size += int64(n)
+	}
+	return fw.removeOldLocked()
+}
+
+func (fw *FileWriter) closeLocked() error {
+	if fw.f == nil {
+		return nil
+	}
+	err := fw.w.Flush()
+	if cerr := fw.f.Close(); err == nil {
+		err = cerr
+	}
+	fw.f, fw.w = nil, nil
+	return err
+}
+
+// removeOldLocked removes the oldest files beyond MaxFiles.
+func (fw *FileWriter) removeOldLocked() error {
+	files, err := fw.filesLocked()
+	if err != nil {
+		return err
+	}
+	maxFiles := fw.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = DefaultMaxFiles
+	}
+	for len(files) > maxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// filesLocked returns the paths of the log files of Dir, the oldest first.
+func (fw *FileWriter) filesLocked() ([]string, error) {
+	var files []string
+	for _, ext := range []string{FormatJSONL, FormatCSV} {
+		matches, err := filepath.Glob(filepath.Join(fw.Dir, filePrefix+"*."+ext))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+	return files, nil
+}
+
+func (fw *FileWriter) format() string {
+	if fw.Format == FormatCSV {
+		return FormatCSV
+	}
+	return FormatJSONL
+}
+
+func (fw *FileWriter) maxSize() int64 {
+	if fw.MaxSize > 0 {
+		return fw.MaxSize
+	}
+	return DefaultMaxSize
+}
+
+func (fw *FileWriter) maxAge() time.Duration {
+	if fw.MaxAge > 0 {
+		return fw.MaxAge
+	}
+	return DefaultMaxAge
+}
+
+// Export writes entries to a new file named name in dir and returns its path.
+// As the file is written by the service on behalf of clients, name must be a
+// plain file name, not a path, ending with the extension of the format,
+// .jsonl or .csv, and the file must not exist. dir is created if needed.
+func Export(dir, name string, entries []Entry) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\:`) {
+		return "", fmt.Errorf("%q: invalid file name", name)
+	}
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+	if format != FormatJSONL && format != FormatCSV {
+		return "", fmt.Errorf("%s: must end with .%s or .%s", name, FormatJSONL, FormatCSV)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	if format == FormatCSV {
+		_, _ = w.WriteString(strings.Join(csvHeader, ",") + "\n")
+	}
+	for _, e := range entries {
+		b, err := encodeEntry(e, format)
+		if err != nil {
+			f.Close()
+			return "", err
+		}
+		_, _ = w.Write(b)
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return path, err
+}
+
+// jsonEntry is the JSON encoding of an Entry.
+type jsonEntry struct {
+	ID        uint64    `json:"id"`
+	Time      time.Time `json:"time"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	RCode     string    `json:"rcode"`
+	Answers   []string  `json:"answers"`
+	Source    string    `json:"source"`
+	Upstream  string    `json:"upstream"`
+	LatencyMs float64   `json:"latencyMs"`
+}
+
+// encodeEntry returns the line of e in format.
+func encodeEntry(e Entry, format string) ([]byte, error) {
+	latencyMs := float64(e.Latency) / float64(time.Millisecond)
+	if format == FormatCSV {
+		var b strings.Builder
+		w := csv.NewWriter(&b)
+		err := w.Write([]string{
+			strconv.FormatUint(e.ID, 10),
+			e.Time.UTC().Format(time.RFC3339Nano),
+			e.Name,
+			e.Type,
+			e.RCode,
+			strings.Join(e.Answers, " "),
+			e.Source,
+			e.Upstream,
+			strconv.FormatFloat(latencyMs, 'f', 3, 64),
+		})
+		if err != nil {
+			return nil, err
+		}
+		w.Flush()
+		return []byte(b.String()), w.Error()
+	}
+	b, err := json.Marshal(jsonEntry{
+		ID:        e.ID,
+		Time:      e.Time.UTC(),
+		Name:      e.Name,
+		Type:      e.Type,
+		RCode:     e.RCode,
+		Answers:   e.Answers,
+		Source:    e.Source,
+		Upstream:  e.Upstream,
+		LatencyMs: latencyMs,
+	})
+	return append(b, '\n'), err
+}
+
+// readFile appends to entries those of the log file at path between from and
+// to. Invalid lines are skipped.
+func readFile(path string, entries []Entry, from, to time.Time) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Removed by the rotation.
+			return entries, nil
+		}
+		return entries, err
+	}
+	defer f.Close()
+	add := func(e Entry) {
+		if !e.Time.Before(from) && !e.Time.After(to) {
+			entries = append(entries, e)
+		}
+	}
+	if strings.HasSuffix(path, "."+FormatCSV) {
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = -1
+		for {
+			rec, err := r.Read()
+			if err == io.EOF {
+				return entries, nil
+			}
+			if err != nil {
+				if _, ok := err.(*csv.ParseError); ok {
+					// Skip malformed lines, like a line cut by a crash.
+					continue
+				}
+				return entries, err
+			}
+			if len(rec) != len(csvHeader) || rec[0] == csvHeader[0] {
+				continue
+			}
+			var e Entry
+			e.ID, _ = strconv.ParseUint(rec[0], 10, 64)
+			if e.Time, err = time.Parse(time.RFC3339Nano, rec[1]); err != nil {
+				continue
+			}
+			e.Name, e.Type, e.RCode = rec[2], rec[3], rec[4]
+			e.Answers = strings.Fields(rec[5])
+			e.Source, e.Upstream = rec[6], rec[7]
+			latencyMs, _ := strconv.ParseFloat(rec[8], 64)
+			e.Latency = time.Duration(latencyMs * float64(time.Millisecond))
+			add(e)
+		}
+	}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var je jsonEntry
+		if json.Unmarshal(s.Bytes(), &je) != nil {
+			continue
+		}
+		add(Entry{
+			ID:       je.ID,
+			Time:     je.Time,
+			Name:     je.Name,
+			Type:     je.Type,
+			RCode:    je.RCode,
+			Answers:  je.Answers,
+			Source:   je.Source,
+			Upstream: je.Upstream,
+			Latency:  time.Duration(je.LatencyMs * float64(time.Millisecond)),
+		})
+	}
+	return entries, s.Err()
+}
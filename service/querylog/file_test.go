@@ -0,0 +1,80 @@
+package querylog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExportName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	entries := []Entry{{ID: 1, Time: time.Unix(0, 0), Name: "example.com."}}
+
+	for _, name := range []string{
+		"",
+		"..",
+		"../out.csv",
+		`..\out.csv`,
+		"sub/out.csv",
+		`C:\out.csv`,
+		"C:out.csv",
+		"out.txt",
+		"out",
+	} {
+		if path, err := Export(dir, name, entries); err == nil {
+			t.Errorf("Export(%q) = %s, want error", name, path)
+		}
+	}
+
+	path, err := Export(dir, "out.csv", entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "out.csv"); path != want {
+		t.Errorf("path = %s, want %s", path, want)
+	}
+	// Existing files are not overwritten.
+	if _, err := Export(dir, "out.csv", entries); err == nil {
+		t.Error("existing file overwritten")
+	}
+}
+
+func TestReadFileCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queries.csv")
+	data := "id,time,name,type,rcode,answers,source,upstream,latencyMs\n" +
+		"1,1970-01-01T00:00:01Z,a.example.com.,A,NOERROR,,udp,dns.nextdns.io,1\n" +
+		"2,1970-01-01T00:00:02Z,b.\"example.com.,A,NOERROR,,udp,dns.nextdns.io,1\n" +
+		"3,1970-01-01T00:00:03Z,c.example.com.,A,NOERROR,,udp,dns.nextdns.io,1\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Malformed lines are skipped.
+	entries, err := readFile(path, nil, time.Unix(0, 0), time.Unix(10, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].ID != 1 || entries[1].ID != 3 {
+		t.Errorf("entries = %+v, want IDs 1 and 3", entries)
+	}
+
+	// Other errors are returned.
+	bad := filepath.Join(dir, "dir.csv")
+	if err := os.Mkdir(bad, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readFile(bad, nil, time.Unix(0, 0), time.Unix(10, 0)); err == nil {
+		t.Error("read error ignored")
+	}
+}
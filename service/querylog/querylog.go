@@ -0,0 +1,229 @@
+// Package querylog keeps the most recent queries answered by the proxy in
+// memory, for clients to browse or follow them.
+package querylog
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nextdns/windows/proxy"
+)
+
+// DefaultSize defines the default value for Log Size.
+const DefaultSize = 1000
+
+// Entry is a query of the log.
+type Entry struct {
+	// ID identifies the entry. IDs are increasing in the order the entries
+	// are added.
+	ID uint64
+
+	Time    time.Time
+	Name    string
+	Type    string
+	RCode   string
+	Answers []string
+
+	// Source is proxy.SourceLocal, proxy.SourceCache or proxy.SourceUpstream.
+	Source   string
+	Upstream string
+	Latency  time.Duration
+}
+
+// NewEntry returns the entry of the query described by qi.
+func NewEntry(qi proxy.QueryInfo) Entry {
+	return Entry{
+		Time:     qi.Time,
+		Name:     qi.Name,
+		Type:     typeName(qi.Type),
+		RCode:    rcodeName(qi.RCode),
+		Answers:  qi.Answers,
+		Source:   qi.Source,
+		Upstream: qi.Upstream,
+		Latency:  qi.Latency,
+	}
+}
+
+// Data returns e in the format sent to clients.
+func (e Entry) Data() map[string]interface{} {
+	answers := e.Answers
+	if answers == nil {
+		answers = []string{}
+	}
+	return map[string]interface{}{
+		"id":        e.ID,
+		"time":      e.Time.UTC().Format(time.RFC3339Nano),
+		"name":      e.Name,
+		"type":      e.Type,
+		"rcode":     e.RCode,
+		"answers":   answers,
+		"source":    e.Source,
+		"upstream":  e.Upstream,
+		"latencyMs": float64(e.Latency) / float64(time.Millisecond),
+	}
+}
+
+// Log is a fixed-size ring buffer of the most recent entries.
+type Log struct {
+	// Size is the maximum number of entries kept. If zero, DefaultSize is
+	// used. It must not be changed once entries were added.
+	Size int
+
+	mu       sync.Mutex
+	disabled bool
+	entries  []Entry
+	next     int // index of the next entry in entries
+	lastID   uint64
+	subs     map[int]func(Entry)
+	lastSub  int
+}
+
+// SetEnabled enables or disables the log. When disabled, the entries are
+// dropped and added entries are ignored.
+func (l *Log) SetEnabled(enabled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.disabled = !enabled
+	if !enabled {
+		l.entries = nil
+		l.next = 0
+	}
+}
+
+// Enabled returns true if the log is enabled.
+func (l *Log) Enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.disabled
+}
+
+// Add adds e to the log with the next ID, replacing the oldest entry if the
+// log is full, and passes it to the subscribers.
+func (l *Log) Add(e Entry) {
+	l.mu.Lock()
+	if l.disabled {
+		l.mu.Unlock()
+		return
+	}
+	size := l.Size
+	if size <= 0 {
+		size = DefaultSize
+	}
+	l.lastID++
+	e.ID = l.lastID
+	if len(l.entries) < size {
+		l.entries = append(l.entries, e)
+	} else {
+		l.entries[l.next] = e
+	}
+	l.next = (l.next + 1) % size
+	subs := make([]func(Entry), 0, len(l.subs))
+	for _, f := range l.subs {
+		subs = append(subs, f)
+	}
+	l.mu.Unlock()
+	for _, f := range subs {
+		f(e)
+	}
+}
+
+// Entries returns up to limit entries with an ID lower than before, the most
+// recent first. If before is zero, the most recent entries are returned. If
+// limit is not positive, all the matching entries are returned.
+func (l *Log) Entries(before uint64, limit int) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := []Entry{}
+	for i := 1; i <= len(l.entries); i++ {
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
+		e := l.entries[(l.next-i+len(l.entries))%len(l.entries)]
+		if before == 0 || e.ID < before {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Range returns the entries between from and to, the oldest first.
+func (l *Log) Range(from, to time.Time) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := []Entry{}
+	for i := range l.entries {
+		e := l.entries[(l.next+i)%len(l.entries)]
+		if !e.Time.Before(from) && !e.Time.After(to) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Subscribe calls f with each entry added to the log until the returned
+// function is called. f is called synchronously and must not block.
+func (l *Log) Subscribe(f func(Entry)) (unsubscribe func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.subs == nil {
+		l.subs = map[int]func(Entry){}
+	}
+	l.lastSub++
+	id := l.lastSub
+	l.subs[id] = f
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.subs, id)
+	}
+}
+
+var typeNames = map[uint16]string{
+	1:   "A",
+	2:   "NS",
+	5:   "CNAME",
+	6:   "SOA",
+	12:  "PTR",
+	15:  "MX",
+	16:  "TXT",
+	28:  "AAAA",
+	33:  "SRV",
+	35:  "NAPTR",
+	43:  "DS",
+	48:  "DNSKEY",
+	64:  "SVCB",
+	65:  "HTTPS",
+	255: "ANY",
+	257: "CAA",
+}
+
+// typeName returns the mnemonic of the t query type, or TYPEn as defined by
+// RFC 3597 for unknown types.
+func typeName(t uint16) string {
+	if name, found := typeNames[t]; found {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+var rcodeNames = map[int]string{
+	0: "NOERROR",
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
+// rcodeName returns the mnemonic of the rcode response code, or an empty
+// string if no response was sent.
+func rcodeName(rcode int) string {
+	if rcode < 0 {
+		return ""
+	}
+	if name, found := rcodeNames[rcode]; found {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(rcode)
+}
@@ -0,0 +1,57 @@
+package settings
+
+// ForwardSystem is the ForwardingRule Upstream sending queries to the
+// resolvers of the network, as configured by DHCP.
+const ForwardSystem = "system"
+
+// ForwardingRule sends the queries for a domain and its subdomains to a
+// specific upstream instead of NextDNS.
+type ForwardingRule struct {
+	// Domain is the domain suffix matched by the rule.
+	Domain string
+
+	// Upstream is the IP address of a DNS server with an optional port, a
+	// DoH URL with a bootstrap IP (https://doh.example/dns-query#192.0.2.1)
+	// or an IP as host, or ForwardSystem.
+	Upstream string
+}
+
+// ForwardingRulesFromData parses a list of rules received as JSON:
+//
+//	[{"domain": "corp.example", "upstream": "10.0.0.1"}, ...]
+//
+// Invalid entries are skipped.
+func ForwardingRulesFromData(v interface{}) []ForwardingRule {
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	var rules []ForwardingRule
+	for _, r := range l {
+		m, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var rule ForwardingRule
+		rule.Domain, _ = m["domain"].(string)
+		rule.Upstream, _ = m["upstream"].(string)
+		if rule.Domain == "" || rule.Upstream == "" {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// ForwardingRulesData returns rules in the format parsed by
+// ForwardingRulesFromData.
+func ForwardingRulesData(rules []ForwardingRule) []interface{} {
+	l := make([]interface{}, 0, len(rules))
+	for _, r := range rules {
+		l = append(l, map[string]interface{}{
+			"domain":   r.Domain,
+			"upstream": r.Upstream,
+		})
+	}
+	return l
+}
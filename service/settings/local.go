@@ -0,0 +1,64 @@
+package settings
+
+// LocalRecord is a DNS record answered locally instead of being resolved by
+// NextDNS.
+type LocalRecord struct {
+	// Name is the domain name owning the record.
+	Name string
+
+	// Type is A, AAAA, CNAME or PTR.
+	Type string
+
+	// Value is an IP address for A and AAAA records, or a domain name for
+	// CNAME and PTR records.
+	Value string
+
+	// TTL is the TTL of the record in seconds. If zero, a default is used.
+	TTL int
+}
+
+// LocalRecordsFromData parses a list of records received as JSON:
+//
+//	[{"name": "test.example", "type": "A", "value": "10.0.0.2", "ttl": 60}, ...]
+//
+// Invalid entries are skipped.
+func LocalRecordsFromData(v interface{}) []LocalRecord {
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	var records []LocalRecord
+	for _, r := range l {
+		m, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var rec LocalRecord
+		rec.Name, _ = m["name"].(string)
+		rec.Type, _ = m["type"].(string)
+		rec.Value, _ = m["value"].(string)
+		if ttl, ok := m["ttl"].(float64); ok && ttl > 0 {
+			rec.TTL = int(ttl)
+		}
+		if rec.Name == "" || rec.Type == "" || rec.Value == "" {
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// LocalRecordsData returns records in the format parsed by
+// LocalRecordsFromData.
+func LocalRecordsData(records []LocalRecord) []interface{} {
+	l := make([]interface{}, 0, len(records))
+	for _, r := range records {
+		l = append(l, map[string]interface{}{
+			"name":  r.Name,
+			"type":  r.Type,
+			"value": r.Value,
+			"ttl":   r.TTL,
+		})
+	}
+	return l
+}
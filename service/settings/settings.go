@@ -1,11 +1,79 @@
 package settings
 
+const (
+	// FailClosed is the FailurePolicy under which queries fail while NextDNS
+	// is unreachable. It is the default.
+	FailClosed = "closed"
+
+	// FailOpen is the FailurePolicy falling back to the resolvers of the
+	// network while NextDNS is unreachable.
+	FailOpen = "open"
+)
+
 type Settings struct {
 	Enabled          bool
 	Configuration    string
 	ReportDeviceName bool
 	CheckUpdates     bool
 	UpdateChannel    string
+	ForwardingRules  []ForwardingRule
+
+	// LocalRecords are answered by the proxy without contacting NextDNS.
+	LocalRecords []LocalRecord
+	// HostsFile is the path of a file in the hosts format whose entries are
+	// answered like LocalRecords. It is reloaded when modified.
+	HostsFile string
+	// UseSystemHosts imports the entries of the system hosts file.
+	UseSystemHosts bool
+
+	// SpecialUse defines how special-use names are resolved.
+	SpecialUse SpecialUse
+
+	// DisableCaptivePortal disables the detection of captive portals.
+	DisableCaptivePortal bool
+	// CaptiveProbeURL is the URL probed to detect captive portals. If empty,
+	// a default is used.
+	CaptiveProbeURL string
+
+	// FailurePolicy is FailClosed or FailOpen. An empty value is FailClosed.
+	FailurePolicy string
+	// FailOpenFailures is the number of consecutive failures after which
+	// FailOpen falls back. If zero, a default is used.
+	FailOpenFailures int
+	// FailOpenTimeout is the time in seconds NextDNS must keep failing for
+	// FailOpen to fall back. If zero, a default is used.
+	FailOpenTimeout int
+
+	// SecondaryUpstreams lists the DoH servers used when NextDNS is
+	// unreachable, as parsed by ParseUpstream.
+	SecondaryUpstreams []string
+
+	// DisableQueryLog disables the query log for privacy: no query is kept
+	// nor sent to clients.
+	DisableQueryLog bool
+	// QueryLogFormat is the format of the query log files, "jsonl" or "csv".
+	// If empty, the query log is not written to disk.
+	QueryLogFormat string
+	// QueryLogDir is the directory of the query log files. It must be within
+	// the data directory of the service, %ProgramData%\NextDNS. If empty, a
+	// default is used.
+	QueryLogDir string
+	// QueryLogMaxSize is the size in MB after which a new query log file is
+	// started. If zero, a default is used.
+	QueryLogMaxSize int
+	// QueryLogMaxAge is the age in hours after which a new query log file is
+	// started. If zero, a default is used.
+	QueryLogMaxAge int
+	// QueryLogMaxFiles is the number of query log files kept. If zero, a
+	// default is used.
+	QueryLogMaxFiles int
+
+	// DoTFallback sends the queries failing with DoH to NextDNS with DoT.
+	DoTFallback bool
+
+	// MetricsPort is the port on which metrics are served over HTTP on
+	// 127.0.0.1. If zero, metrics are only available to ctl clients.
+	MetricsPort int
 }
 
 func FromMap(m map[string]interface{}) Settings {
@@ -25,5 +93,60 @@ func FromMap(m map[string]interface{}) Settings {
 	if v, ok := m["updateChannel"].(string); ok {
 		s.UpdateChannel = v
 	}
+	s.ForwardingRules = ForwardingRulesFromData(m["forwardingRules"])
+	s.LocalRecords = LocalRecordsFromData(m["localRecords"])
+	if v, ok := m["hostsFile"].(string); ok {
+		s.HostsFile = v
+	}
+	if v, ok := m["useSystemHosts"].(bool); ok {
+		s.UseSystemHosts = v
+	}
+	s.SpecialUse = SpecialUseFromData(m["specialUse"])
+	if v, ok := m["disableCaptivePortal"].(bool); ok {
+		s.DisableCaptivePortal = v
+	}
+	if v, ok := m["captiveProbeURL"].(string); ok {
+		s.CaptiveProbeURL = v
+	}
+	if v, ok := m["failurePolicy"].(string); ok {
+		s.FailurePolicy = v
+	}
+	if v, ok := m["failOpenFailures"].(float64); ok {
+		s.FailOpenFailures = int(v)
+	}
+	if v, ok := m["failOpenTimeout"].(float64); ok {
+		s.FailOpenTimeout = int(v)
+	}
+	if v, ok := m["disableQueryLog"].(bool); ok {
+		s.DisableQueryLog = v
+	}
+	if v, ok := m["queryLogFormat"].(string); ok {
+		s.QueryLogFormat = v
+	}
+	if v, ok := m["queryLogDir"].(string); ok {
+		s.QueryLogDir = v
+	}
+	if v, ok := m["queryLogMaxSize"].(float64); ok {
+		s.QueryLogMaxSize = int(v)
+	}
+	if v, ok := m["queryLogMaxAge"].(float64); ok {
+		s.QueryLogMaxAge = int(v)
+	}
+	if v, ok := m["queryLogMaxFiles"].(float64); ok {
+		s.QueryLogMaxFiles = int(v)
+	}
+	if v, ok := m["dotFallback"].(bool); ok {
+		s.DoTFallback = v
+	}
+	if v, ok := m["metricsPort"].(float64); ok {
+		s.MetricsPort = int(v)
+	}
+	if l, ok := m["secondaryUpstreams"].([]interface{}); ok {
+		for _, v := range l {
+			if v, ok := v.(string); ok && v != "" {
+				s.SecondaryUpstreams = append(s.SecondaryUpstreams, v)
+			}
+		}
+	}
 	return s
 }
@@ -0,0 +1,48 @@
+package settings
+
+const (
+	// SpecialAnswer answers the special-use names locally as specified by
+	// RFC 6761 and RFC 6303. It is the default.
+	SpecialAnswer = "answer"
+
+	// SpecialForward resolves the special-use names with the upstream like
+	// any other name.
+	SpecialForward = "forward"
+)
+
+// SpecialUse defines how each category of special-use names is resolved:
+// SpecialAnswer, SpecialForward or ForwardSystem to send the queries to the
+// resolvers of the network. An empty value is SpecialAnswer.
+type SpecialUse struct {
+	// Local is for the .local multicast DNS names.
+	Local string
+
+	// Localhost is for localhost and its subdomains.
+	Localhost string
+
+	// Invalid is for .invalid names.
+	Invalid string
+
+	// SingleLabel is for names with a single label, like "printer".
+	SingleLabel string
+
+	// PrivateReverse is for the reverse lookups of private IP addresses.
+	PrivateReverse string
+}
+
+// SpecialUseFromData parses the special-use policy received as JSON:
+//
+//	{"local": "answer", "singleLabel": "system", "privateReverse": "forward"}
+func SpecialUseFromData(v interface{}) SpecialUse {
+	var s SpecialUse
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return s
+	}
+	s.Local, _ = m["local"].(string)
+	s.Localhost, _ = m["localhost"].(string)
+	s.Invalid, _ = m["invalid"].(string)
+	s.SingleLabel, _ = m["singleLabel"].(string)
+	s.PrivateReverse, _ = m["privateReverse"].(string)
+	return s
+}
@@ -0,0 +1,185 @@
+package settings
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Upstream is the DNS server queries are sent to, as set by the Configuration
+// setting.
+type Upstream struct {
+	// ConfigID is the NextDNS configuration ID. It is empty when a custom
+	// server is used.
+	ConfigID string
+
+	// URL is the URL of a custom server, either a DoH URL (https://) or a DoT
+	// one (tls://host[:port]).
+	URL string
+
+	// Bootstrap lists the IP addresses of the custom server, so it can be
+	// contacted without resolving its hostname.
+	Bootstrap []string
+}
+
+// Custom returns true if u is not a NextDNS configuration.
+func (u Upstream) Custom() bool {
+	return u.URL != ""
+}
+
+// Upstream parses the Configuration setting. See ParseUpstream.
+func (s Settings) Upstream() (Upstream, error) {
+	return ParseUpstream(s.Configuration)
+}
+
+// ParseUpstream parses conf which can be a NextDNS configuration ID, a DoH or
+// DoT URL, or a DoH or DoT DNS stamp (sdns://). An IP address can be given in
+// the fragment of the URL to avoid resolving its host:
+//
+//	https://doh.example.com/dns-query#192.0.2.1
+func ParseUpstream(conf string) (Upstream, error) {
+	switch {
+	case strings.HasPrefix(conf, "sdns://"):
+		return parseStamp(conf)
+	case strings.HasPrefix(conf, "https://"), strings.HasPrefix(conf, "tls://"):
+		u, err := url.Parse(conf)
+		if err != nil {
+			return Upstream{}, err
+		}
+		if u.Host == "" {
+			return Upstream{}, fmt.Errorf("%s: missing host", conf)
+		}
+		var up Upstream
+		if u.Fragment != "" {
+			for _, ip := range strings.Split(u.Fragment, ",") {
+				if net.ParseIP(ip) == nil {
+					return Upstream{}, fmt.Errorf("%s: invalid bootstrap IP: %s", conf, ip)
+				}
+				up.Bootstrap = append(up.Bootstrap, ip)
+			}
+			u.Fragment = ""
+		}
+		up.URL = u.String()
+		return up, nil
+	case strings.Contains(conf, "/"), strings.Contains(conf, ":"):
+		return Upstream{}, fmt.Errorf("%s: unsupported upstream", conf)
+	}
+	return Upstream{ConfigID: conf}, nil
+}
+
+// Stamp protocol identifiers, see https://dnscrypt.info/stamps-specifications.
+const (
+	stampDoH = 0x02
+	stampDoT = 0x03
+)
+
+var errInvalidStamp = errors.New("invalid DNS stamp")
+
+// parseStamp decodes a DoH or DoT DNS stamp.
+func parseStamp(s string) (Upstream, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, "sdns://"))
+	if err != nil {
+		return Upstream{}, errInvalidStamp
+	}
+	if len(b) < 9 {
+		return Upstream{}, errInvalidStamp
+	}
+	proto := b[0]
+	r := stampReader(b[9:]) // Skip the protocol and properties.
+	addr, ok := r.lp()
+	if !ok {
+		return Upstream{}, errInvalidStamp
+	}
+	if _, ok := r.vlp(); !ok { // Certificate hashes, unused.
+		return Upstream{}, errInvalidStamp
+	}
+	host, ok := r.lp()
+	if !ok || len(host) == 0 {
+		return Upstream{}, errInvalidStamp
+	}
+	var path []byte
+	switch proto {
+	case stampDoH:
+		if path, ok = r.lp(); !ok {
+			return Upstream{}, errInvalidStamp
+		}
+	case stampDoT:
+	default:
+		return Upstream{}, fmt.Errorf("unsupported DNS stamp protocol: %#x", proto)
+	}
+	var ips [][]byte
+	if len(r) > 0 {
+		if ips, ok = r.vlp(); !ok {
+			return Upstream{}, errInvalidStamp
+		}
+	}
+
+	var up Upstream
+	hostname := string(host)
+	if len(addr) > 0 {
+		ip, port := string(addr), ""
+		if h, p, err := net.SplitHostPort(ip); err == nil {
+			ip, port = h, p
+		}
+		ip = strings.Trim(ip, "[]")
+		if net.ParseIP(ip) == nil {
+			return Upstream{}, errInvalidStamp
+		}
+		up.Bootstrap = append(up.Bootstrap, ip)
+		if _, _, err := net.SplitHostPort(hostname); err != nil && port != "" {
+			hostname = net.JoinHostPort(hostname, port)
+		}
+	}
+	for _, ip := range ips {
+		if net.ParseIP(string(ip)) != nil {
+			up.Bootstrap = append(up.Bootstrap, string(ip))
+		}
+	}
+	if proto == stampDoH {
+		up.URL = "https://" + hostname + string(path)
+	} else {
+		up.URL = "tls://" + hostname
+	}
+	return up, nil
+}
+
+// stampReader reads the length-prefixed fields of a stamp.
+type stampReader []byte
+
+// lp reads a length-prefixed field.
+func (r *stampReader) lp() ([]byte, bool) {
+	b := *r
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, false
+	}
+	v := b[1 : 1+int(b[0])]
+	*r = b[1+int(b[0]):]
+	return v, true
+}
+
+// vlp reads a variable-length set of length-prefixed fields, where the high
+// bit of the length indicates that another field follows.
+func (r *stampReader) vlp() ([][]byte, bool) {
+	var vs [][]byte
+	for {
+		b := *r
+		if len(b) < 1 {
+			return nil, false
+		}
+		more := b[0]&0x80 != 0
+		l := int(b[0] &^ 0x80)
+		if len(b) < 1+l {
+			return nil, false
+		}
+		if l > 0 {
+			vs = append(vs, b[1:1+l])
+		}
+		*r = b[1+l:]
+		if !more {
+			return vs, true
+		}
+	}
+}
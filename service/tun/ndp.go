@@ -0,0 +1,92 @@
+package tun
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	ipv6HeaderLen = 40
+
+	protoICMPv6 = 58
+
+	icmpv6NeighborSolicitation  = 135
+	icmpv6NeighborAdvertisement = 136
+
+	ndpOptTargetLinkLayerAddr = 2
+)
+
+// resolverMAC is the link-layer address announced for the IPv6 DNS addresses
+// of the tun interface. It is locally administered.
+var resolverMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x42}
+
+// neighborSolicitationTarget returns the target address of pkt if it is an
+// ICMPv6 neighbor solicitation, nil otherwise.
+func neighborSolicitationTarget(pkt []byte) net.IP {
+	// IPv6 header + ICMPv6 type, code, checksum, reserved + target.
+	if len(pkt) < ipv6HeaderLen+8+16 || pkt[0]>>4 != 6 || pkt[6] != protoICMPv6 {
+		return nil
+	}
+	icmp := pkt[ipv6HeaderLen:]
+	if icmp[0] != icmpv6NeighborSolicitation || icmp[1] != 0 {
+		return nil
+	}
+	return net.IP(icmp[8:24])
+}
+
+// neighborAdvertisement builds in buf a neighbor advertisement answering the
+// ns neighbor solicitation, announcing mac as link-layer address of the
+// solicited target. It returns the IPv6 packet.
+func neighborAdvertisement(buf, ns []byte, mac net.HardwareAddr) []byte {
+	target := ns[ipv6HeaderLen+8 : ipv6HeaderLen+24]
+	src := ns[8:24]
+	dst := net.IP(src)
+	flags := uint32(0x60000000) // Solicited, Override
+	if dst.IsUnspecified() {
+		// Solicitation sent during duplicate address detection, answer to
+		// all nodes.
+		dst = net.ParseIP("ff02::1")
+		flags = 0x20000000 // Override
+	}
+	const icmpLen = 8 + 16 + 8
+	pkt := buf[:ipv6HeaderLen+icmpLen]
+	binary.BigEndian.PutUint32(pkt[0:], 6<<28)
+	binary.BigEndian.PutUint16(pkt[4:], icmpLen)
+	pkt[6] = protoICMPv6
+	pkt[7] = 255 // Hop limit must be 255 for NDP
+	copy(pkt[8:24], target)
+	copy(pkt[24:40], dst)
+
+	icmp := pkt[ipv6HeaderLen:]
+	icmp[0] = icmpv6NeighborAdvertisement
+	icmp[1] = 0
+	binary.BigEndian.PutUint16(icmp[2:], 0)
+	binary.BigEndian.PutUint32(icmp[4:], flags)
+	copy(icmp[8:24], target)
+	icmp[24] = ndpOptTargetLinkLayerAddr
+	icmp[25] = 1 // Length in units of 8 bytes
+	copy(icmp[26:32], mac)
+
+	var sum uint32
+	sum = checksum(sum, pkt[8:40])
+	sum += icmpLen
+	sum += protoICMPv6
+	sum = checksum(sum, icmp)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(icmp[2:], ^uint16(sum))
+	return pkt
+}
+
+// checksum adds b to the running one's complement sum.
+func checksum(sum uint32, b []byte) uint32 {
+	n := len(b)
+	for i := 0; i+1 < n; i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if n%2 == 1 {
+		sum += uint32(b[n-1]) << 8
+	}
+	return sum
+}
@@ -10,3 +10,7 @@ import (
 func OpenTunDevice(name, addr, gw, mask string, dns []string) (io.ReadWriteCloser, error) {
 	return nil, errors.New("not implemented")
 }
+
+func AdapterID() (string, error) {
+	return "", errors.New("not implemented")
+}
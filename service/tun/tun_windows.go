@@ -10,6 +10,7 @@ import (
 	"net"
 	"os/exec"
 	"strings"
+	"sync"
 	"syscall"
 	"unsafe"
 
@@ -160,6 +161,12 @@ func getTuntapComponentId() (string, error) {
 	return "", errors.New("not found component id")
 }
 
+// AdapterID returns the component ID of the TAP adapter used by the proxy, or
+// an error if it is not installed.
+func AdapterID() (string, error) {
+	return getTuntapComponentId()
+}
+
 func OpenTunDevice(name, addr, gw, mask string, dns []string) (io.ReadWriteCloser, error) {
 	componentId, err := getTuntapComponentId()
 	if err != nil {
@@ -178,6 +185,34 @@ func OpenTunDevice(name, addr, gw, mask string, dns []string) (io.ReadWriteClose
 	// Set a v6 IP so windaube send AAAA queries
 	netsh("interface", "ipv6", "set", "address", "interface="+TUNTAP_NAME, "fd42:dead:beef::", "store=active")
 
+	// DHCP only carries IPv4 DNS servers, IPv6 ones are set statically.
+	var dns4 []string
+	var dns6 []net.IP
+	for _, s := range dns {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid DNS address: %s", s)
+		}
+		if ip.To4() != nil {
+			dns4 = append(dns4, s)
+			continue
+		}
+		dns6 = append(dns6, ip)
+		netsh("interface", "ipv6", "add", "route", s+"/128", "interface="+TUNTAP_NAME, "store=active")
+	}
+	if len(dns4) == 0 {
+		return nil, errors.New("missing IPv4 DNS address")
+	}
+	for i, ip := range dns6 {
+		if i == 0 {
+			netsh("interface", "ipv6", "set", "dnsservers", "name="+TUNTAP_NAME, "source=static",
+				"address="+ip.String(), "register=none", "validate=no")
+		} else {
+			netsh("interface", "ipv6", "add", "dnsservers", "name="+TUNTAP_NAME,
+				"address="+ip.String(), "validate=no")
+		}
+	}
+
 	// Open.
 	fd, err := windows.CreateFile(
 		&devId[0],
@@ -222,10 +257,10 @@ func OpenTunDevice(name, addr, gw, mask string, dns []string) (io.ReadWriteClose
 
 	// Set dns with DHCP.
 	dnsParam := []byte{6, 4}
-	primaryDNS := net.ParseIP(dns[0]).To4()
+	primaryDNS := net.ParseIP(dns4[0]).To4()
 	dnsParam = append(dnsParam, primaryDNS...)
-	if len(dns) >= 2 {
-		secondaryDNS := net.ParseIP(dns[1]).To4()
+	if len(dns4) >= 2 {
+		secondaryDNS := net.ParseIP(dns4[1]).To4()
 		dnsParam = append(dnsParam, secondaryDNS...)
 		dnsParam[1] += 4
 	}
@@ -243,7 +278,7 @@ func OpenTunDevice(name, addr, gw, mask string, dns []string) (io.ReadWriteClose
 		windows.Close(fd)
 		return nil, fmt.Errorf("windows.DeviceIoControl(TAP_WIN_IOCTL_CONFIG_DHCP_SET_OPT): %v", err)
 	} else {
-		log.Printf("set %s with dns: %s through DHCP", TUNTAP_NAME, strings.Join(dns, ","))
+		log.Printf("set %s with dns: %s through DHCP", TUNTAP_NAME, strings.Join(dns4, ","))
 	}
 
 	// Connect.
@@ -262,7 +297,9 @@ func OpenTunDevice(name, addr, gw, mask string, dns []string) (io.ReadWriteClose
 		windows.Close(fd)
 		return nil, fmt.Errorf("windows.DeviceIoControl(TAP_IOCTL_SET_MEDIA_STATUS): %v", err)
 	}
-	return newWinTapDev(fd, addr, gw), nil
+	dev := newWinTapDev(fd, addr, gw)
+	dev.dns6 = dns6
+	return dev, nil
 }
 
 type winTapDev struct {
@@ -271,10 +308,17 @@ type winTapDev struct {
 	addrIP      net.IP
 	gw          string
 	gwIP        net.IP
+	dns6        []net.IP
 	rBuf        [2048]byte
-	wBuf        [2048]byte
-	wInitiated  bool
+	nBuf        [128]byte
 	rOverlapped windows.Overlapped
+
+	// Write state is shared by Write and the neighbor advertisements sent
+	// from Read.
+	wMu         sync.Mutex
+	wBuf        [2048]byte
+	wHdr4       []byte
+	wHdr6       []byte
 	wOverlapped windows.Overlapped
 }
 
@@ -291,7 +335,6 @@ func newWinTapDev(fd windows.Handle, addr string, gw string) *winTapDev {
 		fd:          fd,
 		rOverlapped: rOverlapped,
 		wOverlapped: wOverlapped,
-		wInitiated:  false,
 
 		addr:   addr,
 		addrIP: net.ParseIP(addr).To4(),
@@ -326,16 +369,36 @@ func (dev *winTapDev) Read(data []byte) (int, error) {
 			}
 
 			if dev.rBuf[14]&0xf0 == 0x60 {
-				// discard IPv6 packets
-				continue
+				if target := neighborSolicitationTarget(dev.rBuf[14:nr]); target != nil {
+					if dev.isDNS6(target) {
+						if err := dev.advertise(dev.rBuf[6:12], dev.rBuf[14:nr]); err != nil {
+							return 0, err
+						}
+					}
+					continue
+				}
+				dev.wMu.Lock()
+				if dev.wHdr6 == nil {
+					// Build ether header for writing, answering from the
+					// resolver MAC announced in neighbor advertisements.
+					dev.wHdr6 = make([]byte, 14)
+					copy(dev.wHdr6, dev.rBuf[6:12])
+					copy(dev.wHdr6[6:], resolverMAC)
+					copy(dev.wHdr6[12:], dev.rBuf[12:14])
+				}
+				dev.wMu.Unlock()
+				copy(data, dev.rBuf[14:nr])
+				return nr - 14, nil
 			} else if dev.rBuf[14]&0xf0 == 0x40 {
-				if !dev.wInitiated {
+				dev.wMu.Lock()
+				if dev.wHdr4 == nil {
 					// copy ether header for writing
-					copy(dev.wBuf[:], dev.rBuf[6:12])
-					copy(dev.wBuf[6:], dev.rBuf[0:6])
-					copy(dev.wBuf[12:], dev.rBuf[12:14])
-					dev.wInitiated = true
+					dev.wHdr4 = make([]byte, 14)
+					copy(dev.wHdr4, dev.rBuf[6:12])
+					copy(dev.wHdr4[6:], dev.rBuf[0:6])
+					copy(dev.wHdr4[12:], dev.rBuf[12:14])
 				}
+				dev.wMu.Unlock()
 				copy(data, dev.rBuf[14:nr])
 				return nr - 14, nil
 			}
@@ -343,13 +406,57 @@ func (dev *winTapDev) Read(data []byte) (int, error) {
 	}
 }
 
+func (dev *winTapDev) isDNS6(ip net.IP) bool {
+	for _, dns := range dev.dns6 {
+		if dns.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// advertise answers the ns neighbor solicitation received from peer MAC
+// address.
+func (dev *winTapDev) advertise(peer, ns []byte) error {
+	dev.wMu.Lock()
+	defer dev.wMu.Unlock()
+	copy(dev.nBuf[0:], peer)
+	copy(dev.nBuf[6:], resolverMAC)
+	binary.BigEndian.PutUint16(dev.nBuf[12:], 0x86dd)
+	na := neighborAdvertisement(dev.nBuf[14:], ns, resolverMAC)
+	_, err := dev.writeFrameLocked(dev.nBuf[:14+len(na)])
+	return err
+}
+
 func (dev *winTapDev) Write(data []byte) (int, error) {
+	dev.wMu.Lock()
+	defer dev.wMu.Unlock()
+	hdr := dev.wHdr4
+	if len(data) > 0 && data[0]&0xf0 == 0x60 {
+		hdr = dev.wHdr6
+	}
+	if hdr == nil {
+		return 0, errors.New("write before any packet received")
+	}
+	copy(dev.wBuf[:], hdr)
+	payloadL := copy(dev.wBuf[14:], data)
+	packetL := payloadL + 14
+	nw, err := dev.writeFrameLocked(dev.wBuf[:packetL])
+	if err != nil {
+		return 0, err
+	}
+	if nw != packetL {
+		return 0, fmt.Errorf("write %d packet (%d bytes payload), return %d", packetL, payloadL, nw)
+	} else {
+		return payloadL, nil
+	}
+}
+
+func (dev *winTapDev) writeFrameLocked(frame []byte) (int, error) {
 	var done uint32
 	var nw int
 
-	payloadL := copy(dev.wBuf[14:], data)
-	packetL := payloadL + 14
-	err := windows.WriteFile(dev.fd, dev.wBuf[:packetL], &done, &dev.wOverlapped)
+	err := windows.WriteFile(dev.fd, frame, &done, &dev.wOverlapped)
 	if err != nil {
 		if err != windows.ERROR_IO_PENDING {
 			return 0, err
@@ -363,11 +470,7 @@ func (dev *winTapDev) Write(data []byte) (int, error) {
 	} else {
 		nw = int(done)
 	}
-	if nw != packetL {
-		return 0, fmt.Errorf("write %d packet (%d bytes payload), return %d", packetL, payloadL, nw)
-	} else {
-		return payloadL, nil
-	}
+	return nw, nil
 }
 
 func getOverlappedResult(h windows.Handle, overlapped *windows.Overlapped) (int, error) {
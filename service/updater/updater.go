@@ -32,6 +32,9 @@ type Updater struct {
 
 	OnUpgrade func(newVersion string)
 
+	// OnCheck is called after each check for updates with its error, if any.
+	OnCheck func(err error)
+
 	// ErrorLog specifies an optional log function for errors. If not set,
 	// errors are not reported.
 	ErrorLog func(error)
@@ -88,6 +91,14 @@ func (u *Updater) CheckNow() error {
 		// Updater disabled
 		return nil
 	}
+	err := u.check()
+	if u.OnCheck != nil {
+		u.OnCheck(err)
+	}
+	return err
+}
+
+func (u *Updater) check() error {
 	res, err := http.Get(u.URL)
 	if err != nil {
 		return err
@@ -2,11 +2,14 @@ package windoh
 
 import (
 	"fmt"
+	"net"
 	"net/url"
 	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
+
+	"github.com/nextdns/windows/settings"
 )
 
 const (
@@ -19,8 +22,13 @@ func Available() bool {
 	return err == nil
 }
 
+// nextdnsServers are the NextDNS anycast IPs associated with the DoH
+// template.
+var nextdnsServers = []string{"45.90.28.0", "45.90.30.0"}
+
 type Config struct {
 	id          string
+	custom      settings.Upstream
 	deviceName  string
 	deviceModel string
 	deviceID    string
@@ -52,6 +60,36 @@ func (c *Config) setState(s string) {
 
 func (c *Config) SetConfigID(id string) {
 	c.id = id
+	c.custom = settings.Upstream{}
+}
+
+// SetUpstream sets the server to use, either a NextDNS configuration or a
+// custom DoH server. As Windows associates DoH templates with the IP of the
+// server, custom servers must have bootstrap IPs or an IP as host.
+func (c *Config) SetUpstream(u settings.Upstream) error {
+	if !u.Custom() {
+		c.SetConfigID(u.ConfigID)
+		return nil
+	}
+	if !strings.HasPrefix(u.URL, "https://") {
+		return fmt.Errorf("%s: only DoH servers are supported by Windows", u.URL)
+	}
+	if len(customServers(u)) == 0 {
+		return fmt.Errorf("%s: a bootstrap IP is required", u.URL)
+	}
+	c.custom = u
+	return nil
+}
+
+// customServers returns the IPs of the custom server u.
+func customServers(u settings.Upstream) []string {
+	if len(u.Bootstrap) > 0 {
+		return u.Bootstrap
+	}
+	if pu, err := url.Parse(u.URL); err == nil && net.ParseIP(pu.Hostname()) != nil {
+		return []string{pu.Hostname()}
+	}
+	return nil
 }
 
 func (c *Config) SetDeviceInfo(name, model, id, version string) {
@@ -66,8 +104,12 @@ func (c *Config) Start() error {
 		return err
 	}
 	url := c.url()
+	servers := nextdnsServers
+	if c.custom.Custom() {
+		servers = customServers(c.custom)
+	}
 	first := true
-	for _, ip := range []string{"45.90.28.0", "45.90.30.0"} {
+	for _, ip := range servers {
 		if _, err := netsh("dns", "set", "encryption",
 			"server="+ip,
 			"dohtemplate="+url,
@@ -118,6 +160,9 @@ func (c *Config) Stop() error {
 }
 
 func (c *Config) url() string {
+	if c.custom.Custom() {
+		return c.custom.URL
+	}
 	if c.deviceName == "" {
 		return fmt.Sprintf("https://windows.dns.nextdns.io/%s", c.id)
 	} else {